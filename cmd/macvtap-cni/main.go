@@ -0,0 +1,131 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+
+	"github.com/maiqueb/macvtap-cni/pkg/cni"
+)
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func main() {
+	printVersion := flag.Bool("version", false, "print the plugin version and exit")
+	printCapabilities := flag.Bool("capabilities", false, "print the supported config fields, modes and CNI versions as JSON and exit")
+	printSchema := flag.Bool("schema", false, "print the JSON Schema of the plugin configuration and exit")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Println(bv.BuildString("macvtap"))
+		return
+	}
+	if *printCapabilities {
+		if err := json.NewEncoder(os.Stdout).Encode(cni.GetCapabilities()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *printSchema {
+		fmt.Println(cni.Schema)
+		return
+	}
+
+	// the vendored skel predates the STATUS and GC verbs
+	switch command := os.Getenv("CNI_COMMAND"); command {
+	case "STATUS":
+		runStdinCommand(command, cni.CmdStatus)
+		return
+	case "GC":
+		runStdinCommand(command, cni.CmdGC)
+		return
+	}
+
+	skel.PluginMain(withCNIError(cni.CmdAdd), withCNIError(cni.CmdCheck), withCNIError(cni.CmdDel), cni.SupportedVersions, bv.BuildString("macvtap"))
+}
+
+// withCNIError reports the typed errors of cmd with their CNI error code.
+func withCNIError(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		return cni.AsCNIError(cmd(args))
+	}
+}
+
+// runStdinCommand runs a command that only takes the network configuration,
+// reporting its failure the way the CNI skeleton does. Such commands appeared
+// in spec version 1.1.0.
+func runStdinCommand(command string, cmd func(stdinData []byte) error) {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err == nil {
+		err = checkStdinCommandVersion(command, stdinData)
+	}
+	if err == nil {
+		err = cni.AsCNIError(cmd(stdinData))
+	}
+	if err != nil {
+		e, ok := err.(*types.Error)
+		if !ok {
+			e = &types.Error{Code: 100, Msg: err.Error()}
+		}
+		if err := e.Print(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// checkStdinCommandVersion rejects the configurations whose spec version
+// predates command, or the plugin does not support, the way the CNI skeleton
+// does for the other commands.
+func checkStdinCommandVersion(command string, stdinData []byte) error {
+	confVersion, err := (&version.ConfigDecoder{}).Decode(stdinData)
+	if err != nil {
+		return err
+	}
+	if gtet, err := version.GreaterThanOrEqualTo(confVersion, "1.1.0"); err != nil {
+		return err
+	} else if !gtet {
+		return &types.Error{
+			Code: types.ErrIncompatibleCNIVersion,
+			Msg:  fmt.Sprintf("config version does not allow %s", command),
+		}
+	}
+	if verErr := (&version.Reconciler{}).Check(confVersion, cni.SupportedVersions); verErr != nil {
+		return &types.Error{
+			Code:    types.ErrIncompatibleCNIVersion,
+			Msg:     "incompatible CNI versions",
+			Details: verErr.Details(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// pluginPath is the macvtap binary built for the conformance tests.
+var pluginPath string
+
+func TestMacvtapCni(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Macvtap CNI Conformance Suite")
+}
+
+var _ = BeforeSuite(func() {
+	dir, err := ioutil.TempDir("", "macvtap-cni-conformance")
+	Expect(err).NotTo(HaveOccurred())
+	pluginPath = filepath.Join(dir, "macvtap")
+
+	build := exec.Command("go", "build", "-o", pluginPath, ".")
+	build.Stderr = GinkgoWriter
+	Expect(build.Run()).To(Succeed())
+})
+
+var _ = AfterSuite(func() {
+	if pluginPath != "" {
+		os.RemoveAll(filepath.Dir(pluginPath))
+	}
+})
@@ -0,0 +1,168 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// execPlugin runs the built plugin the way a runtime does, with the CNI
+// parameters in the environment and the configuration on stdin. It returns
+// stdout and whether the plugin exited successfully.
+func execPlugin(command, netns, conf string) ([]byte, bool) {
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID=conformance",
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME=macvt0",
+		"CNI_PATH=/opt/cni/bin",
+	)
+	cmd.Stdin = bytes.NewBufferString(conf)
+	cmd.Stderr = GinkgoWriter
+	stdout, err := cmd.Output()
+	if err != nil {
+		_, ok := err.(*exec.ExitError)
+		Expect(ok).To(BeTrue(), "failed to run the plugin: %v", err)
+		return stdout, false
+	}
+	return stdout, true
+}
+
+// execPluginErr runs the plugin expecting it to fail and decodes the error
+// it reports on stdout.
+func execPluginErr(command, netns, conf string) *types.Error {
+	stdout, ok := execPlugin(command, netns, conf)
+	Expect(ok).To(BeFalse())
+	pluginErr := &types.Error{}
+	Expect(json.Unmarshal(stdout, pluginErr)).To(Succeed())
+	return pluginErr
+}
+
+func netConf(cniVersion string) string {
+	return fmt.Sprintf(`{
+    		"cniVersion": "%s",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "eth0"
+		}`, cniVersion)
+}
+
+var _ = Describe("CNI conformance", func() {
+	It("reports every supported spec version on VERSION", func() {
+		for _, cniVersion := range []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"} {
+			stdout, ok := execPlugin("VERSION", "", netConf(cniVersion))
+			Expect(ok).To(BeTrue())
+
+			var versionInfo struct {
+				CNIVersion        string   `json:"cniVersion"`
+				SupportedVersions []string `json:"supportedVersions"`
+			}
+			Expect(json.Unmarshal(stdout, &versionInfo)).To(Succeed())
+			Expect(versionInfo.SupportedVersions).To(ContainElement(cniVersion))
+		}
+	})
+	It("rejects an unsupported spec version with the incompatible version code", func() {
+		for _, command := range []string{"ADD", "DEL"} {
+			pluginErr := execPluginErr(command, "/var/run/netns/conformance", netConf("9.9.9"))
+			Expect(pluginErr.Code).To(Equal(uint(types.ErrIncompatibleCNIVersion)))
+		}
+	})
+	It("accepts 1.x spec versions on ADD", func() {
+		for _, cniVersion := range []string{"1.0.0", "1.1.0"} {
+			pluginErr := execPluginErr("ADD", "/var/run/netns/conformance", netConf(cniVersion))
+			Expect(pluginErr.Code).NotTo(Equal(uint(types.ErrIncompatibleCNIVersion)))
+		}
+	})
+	It("rejects CHECK for spec versions predating it", func() {
+		pluginErr := execPluginErr("CHECK", "/var/run/netns/conformance", netConf("0.3.1"))
+		Expect(pluginErr.Code).To(Equal(uint(types.ErrIncompatibleCNIVersion)))
+	})
+	It("rejects STATUS and GC for spec versions predating them", func() {
+		for _, command := range []string{"STATUS", "GC"} {
+			for _, cniVersion := range []string{"0.4.0", "1.0.0", "9.9.9"} {
+				pluginErr := execPluginErr(command, "", netConf(cniVersion))
+				Expect(pluginErr.Code).To(Equal(uint(types.ErrIncompatibleCNIVersion)))
+			}
+		}
+	})
+	It("reports missing CNI parameters", func() {
+		pluginErr := execPluginErr("ADD", "", netConf("0.4.0"))
+		Expect(pluginErr.Code).To(Equal(uint(100)))
+		Expect(pluginErr.Msg).To(ContainSubstring("CNI_NETNS"))
+	})
+	It("reports an unknown command", func() {
+		pluginErr := execPluginErr("FROB", "/var/run/netns/conformance", netConf("0.4.0"))
+		Expect(pluginErr.Code).To(Equal(uint(100)))
+		Expect(pluginErr.Msg).To(ContainSubstring("unknown CNI_COMMAND"))
+	})
+	It("reports an invalid configuration as an error result", func() {
+		pluginErr := execPluginErr("ADD", "/var/run/netns/conformance", `{
+    		"cniVersion": "0.4.0",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "eth0",
+    		"mode": "passthrough"
+		}`)
+		// the well known "invalid network config" code
+		Expect(pluginErr.Code).To(Equal(uint(7)))
+		Expect(pluginErr.Msg).To(ContainSubstring(`"mode" must be one of`))
+	})
+	It("succeeds DEL without a network namespace", func() {
+		stdout, ok := execPlugin("DEL", "", netConf("0.4.0"))
+		Expect(ok).To(BeTrue())
+		Expect(stdout).To(BeEmpty())
+	})
+	It("removes the files of stale attachments on GC", func() {
+		// keep every piece of plugin state away from the host
+		dir, err := ioutil.TempDir("", "macvtap-gc")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		warningsDir := filepath.Join(dir, "warnings")
+		// the warnings dir is shared with another network
+		for _, path := range []string{"mynet/valid-macvt0.json", "mynet/stale-macvt0.json", "othernet/stale-macvt0.json"} {
+			Expect(os.MkdirAll(filepath.Join(warningsDir, filepath.Dir(path)), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(warningsDir, path), []byte("[]"), 0644)).To(Succeed())
+		}
+
+		_, ok := execPlugin("GC", "", fmt.Sprintf(`{
+    		"cniVersion": "1.1.0",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "eth0",
+    		"stateDir": "%[1]s/state",
+    		"warningsDir": "%[1]s/warnings",
+    		"handoffDir": "%[1]s/handoff",
+    		"failuresDir": "%[1]s/failures",
+    		"cni.dev/valid-attachments": [{"containerID": "valid", "ifname": "macvt0"}]
+		}`, dir))
+		Expect(ok).To(BeTrue())
+
+		Expect(filepath.Join(warningsDir, "mynet", "valid-macvt0.json")).To(BeAnExistingFile())
+		Expect(filepath.Join(warningsDir, "mynet", "stale-macvt0.json")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(warningsDir, "othernet", "stale-macvt0.json")).To(BeAnExistingFile())
+	})
+})
@@ -7,5 +7,7 @@ require (
 	github.com/containernetworking/plugins v0.8.3
 	github.com/onsi/ginkgo v1.10.3
 	github.com/onsi/gomega v1.7.1
+	github.com/safchain/ethtool v0.0.0-20190326074333-42ed695e3de8
 	github.com/vishvananda/netlink v1.0.0
+	golang.org/x/sys v0.0.0-20190616124812-15dcb6c0061f
 )
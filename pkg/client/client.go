@@ -0,0 +1,173 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client drives the macvtap plugin binary through libcni, the way a
+// container runtime does, for projects that attach macvtaps programmatically
+// (e.g. from integration tests).
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/maiqueb/macvtap-cni/pkg/cni"
+)
+
+const (
+	pluginType        = "macvtap"
+	defaultCNIVersion = "0.4.0"
+)
+
+// Client invokes the macvtap plugin found in one of its plugin dirs.
+type Client struct {
+	cniConfig *libcni.CNIConfig
+}
+
+// Attachment identifies one attachment of a container to a macvtap network.
+// MAC and Mode are passed to the plugin as the MAC and MODE CNI_ARGS when set.
+type Attachment struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+	MAC         string
+	Mode        string
+}
+
+// Interface is a macvtap created by an ADD.
+type Interface struct {
+	Name    string
+	MAC     string
+	Sandbox string
+	// TapPath is the character device backing the macvtap.
+	TapPath string
+}
+
+// Result is the outcome of an ADD.
+type Result struct {
+	CNIVersion string
+	Interfaces []Interface
+}
+
+// New returns a client running the plugin binary found in pluginDirs.
+func New(pluginDirs []string) *Client {
+	return &Client{cniConfig: libcni.NewCNIConfig(pluginDirs, nil)}
+}
+
+// networkConfig renders conf as the plugin's stdin configuration, filling
+// in the plugin type and, when unset, the CNI version.
+func networkConfig(conf *cni.NetConf) (*libcni.NetworkConfig, error) {
+	c := *conf
+	c.Type = pluginType
+	if c.CNIVersion == "" {
+		c.CNIVersion = defaultCNIVersion
+	}
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return nil, err
+	}
+	return libcni.ConfFromBytes(data)
+}
+
+func runtimeConf(attachment Attachment) *libcni.RuntimeConf {
+	rt := &libcni.RuntimeConf{
+		ContainerID: attachment.ContainerID,
+		NetNS:       attachment.Netns,
+		IfName:      attachment.IfName,
+	}
+	if attachment.MAC != "" {
+		rt.Args = append(rt.Args, [2]string{"MAC", attachment.MAC})
+	}
+	if attachment.Mode != "" {
+		rt.Args = append(rt.Args, [2]string{"MODE", attachment.Mode})
+	}
+	return rt
+}
+
+// Add attaches the container to the network described by conf.
+func (c *Client) Add(ctx context.Context, conf *cni.NetConf, attachment Attachment) (*Result, error) {
+	netConf, err := networkConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.cniConfig.AddNetwork(ctx, netConf, runtimeConf(attachment))
+	if err != nil {
+		return nil, err
+	}
+	addResult, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the plugin result: %v", err)
+	}
+
+	result := &Result{CNIVersion: addResult.CNIVersion}
+	for _, iface := range addResult.Interfaces {
+		result.Interfaces = append(result.Interfaces, Interface{
+			Name:    iface.Name,
+			MAC:     iface.Mac,
+			Sandbox: iface.Sandbox,
+		})
+	}
+	if err := tapPaths(attachment.Netns, result.Interfaces); err != nil {
+		// do not leave behind an attachment the caller knows nothing about
+		if derr := c.cniConfig.DelNetwork(ctx, netConf, runtimeConf(attachment)); derr != nil {
+			return nil, fmt.Errorf("%v (and failed to undo the ADD: %v)", err, derr)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// tapPaths fills in the character devices backing interfaces, which live in
+// the netns netnsRef refers to.
+func tapPaths(netnsRef string, interfaces []Interface) error {
+	netnsPath, err := cni.ResolveNetns(netnsRef)
+	if err != nil {
+		return err
+	}
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		for i := range interfaces {
+			link, err := netlink.LinkByName(interfaces[i].Name)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", interfaces[i].Name, err)
+			}
+			interfaces[i].TapPath = cni.TapDevicePath(link.Attrs().Index)
+		}
+		return nil
+	})
+}
+
+// Check verifies that the attachment still matches conf.
+func (c *Client) Check(ctx context.Context, conf *cni.NetConf, attachment Attachment) error {
+	netConf, err := networkConfig(conf)
+	if err != nil {
+		return err
+	}
+	return c.cniConfig.CheckNetwork(ctx, netConf, runtimeConf(attachment))
+}
+
+// Del detaches the container from the network described by conf.
+func (c *Client) Del(ctx context.Context, conf *cni.NetConf, attachment Attachment) error {
+	netConf, err := networkConfig(conf)
+	if err != nil {
+		return err
+	}
+	return c.cniConfig.DelNetwork(ctx, netConf, runtimeConf(attachment))
+}
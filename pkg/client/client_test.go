@@ -0,0 +1,77 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/maiqueb/macvtap-cni/pkg/cni"
+)
+
+var _ = Describe("macvtap client", func() {
+	It("renders a configuration the plugin accepts", func() {
+		conf := &cni.NetConf{Master: "eth0", Mode: "vepa"}
+		conf.Name = "mynet"
+
+		netConf, err := networkConfig(conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.Network.Type).To(Equal("macvtap"))
+		Expect(netConf.Network.CNIVersion).To(Equal(defaultCNIVersion))
+
+		loaded, cniVersion, err := cni.LoadConf(netConf.Bytes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cniVersion).To(Equal(defaultCNIVersion))
+		Expect(loaded.Master).To(Equal("eth0"))
+		Expect(loaded.Mode).To(Equal("vepa"))
+		Expect(conf.Type).To(BeEmpty())
+	})
+	It("passes the MAC and mode as CNI_ARGS", func() {
+		rt := runtimeConf(Attachment{ContainerID: "dummy", Netns: "/var/run/netns/ns1", IfName: "macvt0", MAC: "0a:59:00:dc:6a:e0", Mode: "private"})
+		Expect(rt.ContainerID).To(Equal("dummy"))
+		Expect(rt.Args).To(Equal([][2]string{{"MAC", "0a:59:00:dc:6a:e0"}, {"MODE", "private"}}))
+
+		rt = runtimeConf(Attachment{ContainerID: "dummy", Netns: "/var/run/netns/ns1", IfName: "macvt0"})
+		Expect(rt.Args).To(BeEmpty())
+	})
+	It("undoes the ADD when the interfaces cannot be inspected", func() {
+		dir, err := ioutil.TempDir("", "macvtap-client")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		plugin := `#!/bin/sh
+cat > /dev/null
+echo "$CNI_COMMAND" >> "$(dirname "$0")/calls"
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion": "0.3.1", "interfaces": [{"name": "net1", "sandbox": "/nonexistent/netns"}]}'
+fi
+`
+		Expect(ioutil.WriteFile(filepath.Join(dir, "macvtap"), []byte(plugin), 0755)).To(Succeed())
+
+		conf := &cni.NetConf{Master: "eth0"}
+		conf.Name = "mynet"
+		conf.CNIVersion = "0.3.1"
+		_, err = New([]string{dir}).Add(context.Background(), conf, Attachment{ContainerID: "dummy", Netns: "/nonexistent/netns", IfName: "net1"})
+		Expect(err).To(HaveOccurred())
+
+		calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(calls)).To(Equal("ADD\nDEL\n"))
+	})
+})
@@ -0,0 +1,120 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// aliasPrefix marks the link alias of interfaces configured by the plugin.
+const aliasPrefix = "macvtap-cni"
+
+// ConfigDigest returns a short hash of the network configuration passed on
+// stdin, stored on every attachment so that attachments created from an
+// older revision of the network configuration can be detected. The
+// configuration is canonicalized first, so that key order and whitespace do
+// not count, and its prevResult, which the runtime sets differently for ADD
+// and CHECK, is left out.
+func ConfigDigest(stdinData []byte) (string, error) {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return "", fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	delete(conf, "prevResult")
+	// maps are marshalled with sorted keys
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// maxDescriptionLen keeps the alias within the 255 bytes the kernel allows.
+const maxDescriptionLen = 128
+
+// descriptionKey introduces the free-text description, which comes last in
+// the alias since it may contain spaces.
+const descriptionKey = " description="
+
+// linkAlias holds the attributes the plugin records in the link alias, as
+// space separated key=value pairs.
+type linkAlias struct {
+	Digest      string
+	Description string
+}
+
+func (a linkAlias) String() string {
+	alias := fmt.Sprintf("%s digest=%s", aliasPrefix, a.Digest)
+	if a.Description != "" {
+		alias += descriptionKey + a.Description
+	}
+	return alias
+}
+
+func validateDescription(description string) error {
+	if len(description) > maxDescriptionLen {
+		return fmt.Errorf("description is %d bytes long, must be at most %d", len(description), maxDescriptionLen)
+	}
+	for _, r := range description {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("description %q must only contain printable characters", description)
+		}
+	}
+	return nil
+}
+
+// parseLinkAlias parses an alias written by the plugin. ok is false for
+// links the plugin did not configure.
+func parseLinkAlias(alias string) (linkAlias, bool) {
+	fields := strings.Fields(alias)
+	if len(fields) == 0 || fields[0] != aliasPrefix {
+		return linkAlias{}, false
+	}
+	parsed := linkAlias{}
+	if i := strings.Index(alias, descriptionKey); i >= 0 {
+		parsed.Description = alias[i+len(descriptionKey):]
+		fields = strings.Fields(alias[:i])
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 && kv[0] == "digest" {
+			parsed.Digest = kv[1]
+		}
+	}
+	return parsed, true
+}
+
+func setLinkAlias(ifName string, alias linkAlias, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := netlink.LinkSetAlias(link, alias.String()); err != nil {
+			return fmt.Errorf("failed to set the alias of %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SupportedModes lists the macvtap modes the plugin accepts.
+var SupportedModes = []string{"bridge", "private", "vepa"}
+
+// Capabilities describes what the installed plugin supports, so that
+// management layers can feature-detect it.
+type Capabilities struct {
+	ConfigFields []string `json:"configFields"`
+	CNIArgs      []string `json:"cniArgs"`
+	Modes        []string `json:"modes"`
+	CNIVersions  []string `json:"cniVersions"`
+}
+
+// GetCapabilities returns the capabilities of the plugin. The configuration
+// fields and CNI args are derived from NetConf and EnvArgs, so they cannot
+// drift from what the plugin actually parses.
+func GetCapabilities() Capabilities {
+	return Capabilities{
+		ConfigFields: jsonFieldNames(reflect.TypeOf(NetConf{})),
+		CNIArgs:      argNames(reflect.TypeOf(EnvArgs{})),
+		Modes:        SupportedModes,
+		CNIVersions:  SupportedVersions.SupportedVersions(),
+	}
+}
+
+// jsonFieldNames returns the JSON names of the fields t adds on top of its
+// embedded types.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// argNames returns the CNI_ARGS keys t adds on top of its embedded types.
+func argNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); !field.Anonymous {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,616 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// ErrInterfaceExists is the CNI error code ADD returns when one of the
+// interface names it would use is already taken in the container netns.
+const ErrInterfaceExists uint = 101
+
+// maxIfNameLen is the longest interface name the kernel accepts (IFNAMSIZ
+// minus the terminating NUL).
+const maxIfNameLen = 15
+
+// interfaceNames returns the names of the macvtaps handled by one ADD: ifName
+// itself, followed by ifName-1 .. ifName-(count-1) when several interfaces
+// are requested.
+func interfaceNames(ifName string, count int) ([]string, error) {
+	if len(ifName) > maxIfNameLen {
+		return nil, fmt.Errorf("interface name %q is longer than %d characters", ifName, maxIfNameLen)
+	}
+	if count < 1 {
+		count = 1
+	}
+	names := []string{ifName}
+	for i := 1; i < count; i++ {
+		names = append(names, shortenName(ifName, fmt.Sprintf("-%d", i)))
+	}
+	return names, nil
+}
+
+// shortenName returns base+suffix. When that does not fit in IFNAMSIZ, base
+// is truncated and followed by a short hash of it, so that the name stays
+// deterministic and names derived from different long bases do not collide.
+func shortenName(base, suffix string) string {
+	if len(base)+len(suffix) <= maxIfNameLen {
+		return base + suffix
+	}
+	sum := sha256.Sum256([]byte(base))
+	hash := hex.EncodeToString(sum[:2])
+	return base[:maxIfNameLen-len(hash)-len(suffix)] + hash + suffix
+}
+
+// checkInterfacesAbsent fails with a ConflictError if any of ifNames
+// already exists in netns, so ADD bails out before creating anything instead
+// of failing the rename and leaving a temporarily named link behind.
+func checkInterfacesAbsent(ifNames []string, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, ifName := range ifNames {
+			_, err := netlink.LinkByName(ifName)
+			if err == nil {
+				return &ConflictError{fmt.Errorf("interface %q already exists in the container netns", ifName)}
+			}
+			if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return &KernelError{fmt.Errorf("failed to lookup %q: %v", ifName, err)}
+			}
+		}
+		return nil
+	})
+}
+
+// offsetMAC returns mac incremented by offset, so every interface created by
+// one ADD gets a distinct address derived from the requested one.
+func offsetMAC(mac net.HardwareAddr, offset int) net.HardwareAddr {
+	result := make(net.HardwareAddr, len(mac))
+	copy(result, mac)
+	carry := offset
+	for i := len(result) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(result[i]) + carry
+		result[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return result
+}
+
+// parseMacOUI parses the 3 bytes organizationally unique identifier of
+// "macOUI", which must be a unicast prefix.
+func parseMacOUI(oui string) (net.HardwareAddr, error) {
+	prefix, err := net.ParseMAC(oui + ":00:00:00")
+	if err != nil || len(prefix) != 6 {
+		return nil, fmt.Errorf("invalid macOUI %q, must be 3 colon separated bytes", oui)
+	}
+	if prefix[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid macOUI %q, must be a unicast prefix", oui)
+	}
+	return prefix[:3], nil
+}
+
+// withOUI returns mac with its first 3 bytes replaced by oui.
+func withOUI(mac net.HardwareAddr, oui net.HardwareAddr) net.HardwareAddr {
+	result := make(net.HardwareAddr, len(mac))
+	copy(result, mac)
+	copy(result, oui)
+	return result
+}
+
+// setHardwareAddr sets the MAC address of iface. With verify, the address is
+// read back, since some NICs silently ignore the change on macvtaps.
+func setHardwareAddr(iface *current.Interface, mac net.HardwareAddr, verify bool, netns ns.NetNS) error {
+	err := netns.Do(func(_ ns.NetNS) error {
+		macIf, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup new macvtapdevice %q: %v", iface.Name, err)
+		}
+
+		if err = injectFault(faultSetMac); err == nil {
+			err = netlink.LinkSetHardwareAddr(macIf, mac)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add hardware addr to %q: %v", iface.Name, err)
+		}
+		if verify {
+			macIf, err = netlink.LinkByName(iface.Name)
+			if err != nil {
+				return fmt.Errorf("failed to refetch %q: %v", iface.Name, err)
+			}
+			if applied := macIf.Attrs().HardwareAddr; applied.String() != mac.String() {
+				return fmt.Errorf("hardware addr %s did not stick on %q, which has %s", mac, iface.Name, applied)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	iface.Mac = mac.String()
+	return nil
+}
+
+// prevResultMTU returns the MTU of the first container interface reported in
+// the previous result of the chain, or 0 when there is none.
+func prevResultMTU(conf *NetConf, netns ns.NetNS) (int, error) {
+	if conf.PrevResult == nil {
+		return 0, nil
+	}
+	prevResult, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return 0, &ConfigError{fmt.Errorf("failed to convert prevResult: %v", err)}
+	}
+
+	mtu := 0
+	err = netns.Do(func(_ ns.NetNS) error {
+		for _, iface := range prevResult.Interfaces {
+			if iface.Sandbox == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(iface.Name)
+			if err != nil {
+				continue
+			}
+			mtu = link.Attrs().MTU
+			return nil
+		}
+		return nil
+	})
+	return mtu, err
+}
+
+// CmdAdd implements the CNI ADD command.
+func CmdAdd(args *skel.CmdArgs) error {
+	resetWarnings()
+	resetFailure()
+
+	n, cniVersion, err := LoadConf(args.StdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	if err := ClearFailure(networkDir(n.FailuresDir, n.Name), args.ContainerID, args.IfName); err != nil {
+		return &KernelError{err}
+	}
+	result, err := addAttachment(args, n, cniVersion)
+	if err != nil {
+		if werr := writeFailure(networkDir(n.FailuresDir, n.Name), args.ContainerID, args.IfName, err); werr != nil {
+			warnf("%v", werr)
+		}
+		return err
+	}
+	if err = printResult(result, cniVersion); err != nil {
+		return err
+	}
+
+	// the hooks run once the attachment is complete and the master lock is
+	// released: a slow hook must not hold up other ADDs, and a failing one
+	// cannot undo the attachment
+	if n.Hooks != nil && (n.Attach == nil || *n.Attach) {
+		runHooks(n.Hooks.PostAdd, HookEvent{
+			Event:       "postAdd",
+			ContainerID: args.ContainerID,
+			Netns:       args.Netns,
+			IfName:      args.IfName,
+			Interfaces:  result.Interfaces,
+		})
+		if err := writeWarnings(networkDir(n.WarningsDir, n.Name), args.ContainerID, args.IfName); err != nil {
+			fmt.Fprintf(os.Stderr, "macvtap-cni: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// addAttachment runs ADD for a loaded configuration, recording its progress
+// for the failure file.
+func addAttachment(args *skel.CmdArgs, n *NetConf, cniVersion string) (*current.Result, error) {
+	setStep("prepare")
+	envArgs, err := parseEnvArgs(args.Args, !n.FailOnUnknownArgs)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+	applyArgsCNI(n, &envArgs)
+	if err = validateMacOverride(n, envArgs); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if err = ApplyModeOverride(n, envArgs); err != nil {
+		return nil, &ConfigError{err}
+	}
+	digest, err := ConfigDigest(args.StdinData)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+	// node level gates do not count as configuration drift
+	if err = applyFeatureGates(n); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if n.Master != "" {
+		if err = resolveMaster(n); err != nil {
+			return nil, &ConfigError{err}
+		}
+		if n.Vlan != 0 {
+			if err = setupVlan(n, n.Attach == nil || *n.Attach); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	netnsPath, err := ResolveNetns(args.Netns)
+	if err != nil {
+		return nil, &NamespaceError{err}
+	}
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, &NamespaceError{fmt.Errorf("failed to open netns %q: %v", args.Netns, err)}
+	}
+	defer netns.Close()
+
+	if n.AlignMtuWithPrevResult {
+		mtu, err := prevResultMTU(n, netns)
+		if err != nil {
+			return nil, kernelError(err)
+		}
+		if mtu > 0 {
+			n.MTU = mtu
+		}
+	}
+
+	if err = ValidateConf(*n); err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	ifNames, err := interfaceNames(args.IfName, n.Interfaces)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	if n.Attach != nil && !*n.Attach {
+		interfaces, err := planInterfaces(n, envArgs, ifNames, args.Netns)
+		if err != nil {
+			return nil, kernelError(err)
+		}
+		return &current.Result{CNIVersion: cniVersion, Interfaces: interfaces}, nil
+	}
+
+	// every macvtap counts, its MAC address is learnt by the switch
+	if n.Master != "" && n.AddRateLimit != nil {
+		if err = takeAddTokens(n.StateDir, n.Master, n.AddRateLimit, len(ifNames), time.Now()); err != nil {
+			return nil, kernelError(err)
+		}
+	}
+	// creating the macvtaps and changing their MAC addresses updates the
+	// address filters of the master
+	unlock := func() {}
+	if n.Master != "" {
+		if unlock, err = lockLink(n.Master); err != nil {
+			return nil, kernelError(err)
+		}
+	}
+	defer func() { unlock() }()
+
+	// the marker and signal handling let an ADD killed mid-way, e.g. on the
+	// runtime's CNI timeout, be rolled back now or by the next DEL or GC
+	if err = beginAdd(n.StateDir, n.Name, args.ContainerID, args.IfName, args.Netns, netns); err != nil {
+		return nil, kernelError(err)
+	}
+	defer endAdd()
+	stopRollbackOnSignal := rollbackOnSignal()
+	defer stopRollbackOnSignal()
+
+	// checked once the links of a killed ADD for the same attachment, which
+	// may already carry the requested names, are gone
+	if err = checkInterfacesAbsent(ifNames, netns); err != nil {
+		return nil, kernelError(err)
+	}
+
+	var macvtapInterfaces []*current.Interface
+
+	// Delete links if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				for _, iface := range macvtapInterfaces {
+					if err := ip.DelLinkByName(iface.Name); err != nil {
+						recordRollback("failed to delete %s: %v", iface.Name, err)
+					} else {
+						recordRollback("deleted %s", iface.Name)
+					}
+				}
+				if n.Vrf != "" {
+					if err := removeVrfIfUnused(n.Vrf); err != nil {
+						recordRollback("failed to delete vrf %s: %v", n.Vrf, err)
+					}
+				}
+				return nil
+			})
+		}
+	}()
+
+	setStep("create")
+	for _, ifName := range ifNames {
+		var macvtapInterface *current.Interface
+		if n.DeviceID != "" {
+			macvtapInterface, err = ConfigureMacvtap(n, ifName, netns)
+		} else {
+			macvtapInterface, err = CreateMacvtap(n, ifName, netns)
+		}
+		if err != nil {
+			return nil, kernelError(err)
+		}
+		macvtapInterfaces = append(macvtapInterfaces, macvtapInterface)
+	}
+
+	setStep("set-mac")
+	var mac net.HardwareAddr
+	if envArgs.MAC != "" {
+		mac, err = net.ParseMAC(string(envArgs.MAC))
+		if err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	if mac.String() != "" {
+		for i, macvtapInterface := range macvtapInterfaces {
+			if err = setHardwareAddr(macvtapInterface, offsetMAC(mac, i), n.VerifyMac, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	} else if n.MacOUI != "" && n.DeviceID == "" {
+		// keep the random part the kernel generated, under the configured
+		// prefix
+		oui, _ := parseMacOUI(n.MacOUI)
+		for _, macvtapInterface := range macvtapInterfaces {
+			var kernelMAC net.HardwareAddr
+			if kernelMAC, err = net.ParseMAC(macvtapInterface.Mac); err != nil {
+				return nil, kernelError(err)
+			}
+			if err = setHardwareAddr(macvtapInterface, withOUI(kernelMAC, oui), n.VerifyMac, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	setStep("configure")
+	for _, ifName := range ifNames {
+		if err = setLinkAlias(ifName, linkAlias{Digest: digest, Description: n.Description}, netns); err != nil {
+			return nil, kernelError(err)
+		}
+		if n.IfGroup != nil {
+			if err = setInterfaceGroup(ifName, *n.IfGroup, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+		if n.GSOMaxSize != nil || n.GSOMaxSegs != nil {
+			if err = setInterfaceGSO(ifName, n, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+		if n.EnableIPv4 != nil || n.EnableIPv6 != nil {
+			if err = configureAddressFamilies(n, ifName, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+		if n.Vrf != "" {
+			if err = addToVrf(n, ifName, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	setStep("port-rules")
+	if hasPortRules(n) {
+		for _, ifName := range ifNames {
+			if err = installPortRules(n, ifName, netns); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	// the waits below do not touch the master, and must not hold up the
+	// other users of its lock
+	unlock()
+
+	setStep("wait-ready")
+	if n.WaitReady != nil {
+		timeout, _ := parseWaitReadyTimeout(n.WaitReady)
+		for _, ifName := range ifNames {
+			if err = waitForLinkReady(ifName, netns, timeout); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	setStep("wait-devtmpfs")
+	if n.TapDeviceProvisioning == tapProvisioningWaitDevtmpfs {
+		timeout, _ := parseTapDeviceTimeout(n)
+		for _, ifName := range ifNames {
+			if err = waitForTapDevice(ifName, netns, timeout); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	setStep("handoff")
+	if n.HandoffDir != "" {
+		for _, ifName := range ifNames {
+			if err = writeHandoff(networkDir(n.HandoffDir, n.Name), args.ContainerID, args.Netns, netns, ifName); err != nil {
+				return nil, kernelError(err)
+			}
+		}
+	}
+
+	if err = writeWarnings(networkDir(n.WarningsDir, n.Name), args.ContainerID, args.IfName); err != nil {
+		return nil, kernelError(err)
+	}
+
+	// report the netns as the runtime referenced it, the path this process
+	// opened it at means nothing to others for "pid:" and "fd:" references
+	for _, iface := range macvtapInterfaces {
+		iface.Sandbox = args.Netns
+	}
+	result := &current.Result{
+		CNIVersion: cniVersion,
+		Interfaces: macvtapInterfaces,
+	}
+
+	if n.ResultFile != "" {
+		setStep("result-file")
+		if err = writeResultFile(n.ResultFile, args.ContainerID, args.IfName, result, cniVersion); err != nil {
+			return nil, kernelError(err)
+		}
+	}
+
+	return result, nil
+}
+
+// CmdDel implements the CNI DEL command.
+func CmdDel(args *skel.CmdArgs) error {
+	n, _, err := LoadConf(args.StdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	if err := removeWarnings(networkDir(n.WarningsDir, n.Name), args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	if f, err := ReadFailure(networkDir(n.FailuresDir, n.Name), args.ContainerID, args.IfName); err == nil && f != nil {
+		fmt.Fprintf(os.Stderr, "macvtap-cni: clearing the failure of the last ADD at step %q: %s\n", f.Step, f.Error)
+	}
+	if err := ClearFailure(networkDir(n.FailuresDir, n.Name), args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+	if err := removeResultFile(n.ResultFile, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	ifNames, err := interfaceNames(args.IfName, n.Interfaces)
+	if err != nil {
+		return err
+	}
+	if n.HandoffDir != "" {
+		for _, ifName := range ifNames {
+			if err := removeHandoff(networkDir(n.HandoffDir, n.Name), args.ContainerID, ifName); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := cleanupInterruptedAdd(inProgressPath(n.StateDir, n.Name, args.ContainerID, args.IfName)); err != nil {
+		return err
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	if args.Netns == "" {
+		return nil
+	}
+	netnsPath, err := ResolveNetns(args.Netns)
+	if err != nil {
+		return &NamespaceError{err}
+	}
+
+	err = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		for _, ifName := range ifNames {
+			if hasPortRules(n) {
+				// the table may already be gone, and must not block link removal
+				_ = removePortRules(ifName)
+			}
+
+			if err := ip.DelLinkByName(ifName); err != nil {
+				if err != ip.ErrLinkNotFound {
+					return &KernelError{err}
+				}
+			}
+		}
+		if n.Vrf != "" {
+			if err := removeVrfIfUnused(n.Vrf); err != nil {
+				return &KernelError{fmt.Errorf("failed to remove vrf %q: %v", n.Vrf, err)}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return netnsError(err)
+	}
+
+	if n.Hooks != nil {
+		runHooks(n.Hooks.PostDel, HookEvent{
+			Event:       "postDel",
+			ContainerID: args.ContainerID,
+			Netns:       args.Netns,
+			IfName:      args.IfName,
+		})
+	}
+	return nil
+}
+
+// CmdCheck implements the CNI CHECK command.
+// It verifies that every interface of the attachment still exists and was
+// configured from the current network configuration.
+func CmdCheck(args *skel.CmdArgs) error {
+	n, _, err := LoadConf(args.StdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	if _, err := parseEnvArgs(args.Args, !n.FailOnUnknownArgs); err != nil {
+		return &ConfigError{err}
+	}
+	digest, err := ConfigDigest(args.StdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+
+	ifNames, err := interfaceNames(args.IfName, n.Interfaces)
+	if err != nil {
+		return err
+	}
+
+	netnsPath, err := ResolveNetns(args.Netns)
+	if err != nil {
+		return &NamespaceError{err}
+	}
+	err = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		for _, ifName := range ifNames {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+			}
+			// interfaces attached before the plugin recorded digests
+			// carry no alias
+			if link.Attrs().Alias == "" {
+				continue
+			}
+			alias, ok := parseLinkAlias(link.Attrs().Alias)
+			if !ok {
+				return fmt.Errorf("interface %q was not configured by the macvtap plugin", ifName)
+			}
+			if alias.Digest != digest {
+				return fmt.Errorf("interface %q was configured from configuration %s, current configuration is %s", ifName, alias.Digest, digest)
+			}
+		}
+		return nil
+	})
+	return netnsError(err)
+}
@@ -0,0 +1,2658 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const MASTER_NAME = "eth0"
+const macAddress = "0a:59:00:dc:6a:e0"
+
+var _ = Describe("allowed configurations", func() {
+	It("accepts a configuration w/ the 'master' attribute.", func() {
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+		netConf, _, err := LoadConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.Master).To(Equal(MASTER_NAME))
+	})
+	It("accepts a configuration w/ the 'deviceID' attribute.", func() {
+		macvtapIfaceName := "vtap0"
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"deviceID": "%s"
+		}`, macvtapIfaceName)
+		netConf, _, err := LoadConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.DeviceID).To(Equal(macvtapIfaceName))
+	})
+	It("does not accept 'master' *and* 'deviceID' attributes.", func() {
+		macvtapIfaceName := "vtap0"
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+			"type": "macvtap",
+			"master": "eth1",
+    		"deviceID": "%s"
+		}`, macvtapIfaceName)
+		_, _, err := LoadConf([]byte(conf))
+		Expect(err).To(HaveOccurred())
+	})
+	It("prefers the allocated device over 'master' when asked to.", func() {
+		conf := `{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "eth1",
+    		"deviceID": "vtap0",
+    		"preferAllocatedDevice": true
+		}`
+		netConf, _, err := LoadConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.Master).To(BeEmpty())
+		Expect(netConf.DeviceID).To(Equal("vtap0"))
+	})
+	It("requires either 'master' *or* 'deviceID' attributes.", func() {
+		macvtapIfaceName := "vtap0"
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+			"type": "macvtap",
+			"master": "eth1",
+    		"deviceID": "%s"
+		}`, macvtapIfaceName)
+		_, _, err := LoadConf([]byte(conf))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("imported device validation", func() {
+	It("accepts a macvtap device by default", func() {
+		link := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "vtap0"}}}
+		Expect(ValidateDeviceType(link, nil)).To(Succeed())
+	})
+	It("rejects a non-macvtap device by default", func() {
+		link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}
+		Expect(ValidateDeviceType(link, nil)).NotTo(Succeed())
+	})
+	It("accepts a device whose type is explicitly allowed", func() {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dummy0"}}
+		Expect(ValidateDeviceType(link, []string{"macvtap", "dummy"})).To(Succeed())
+	})
+	It("rejects a device enslaved to another device", func() {
+		link := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "vtap0", MasterIndex: 3}}}
+		Expect(ValidateDeviceType(link, nil)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("master kind validation", func() {
+	var origSysClassNet string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "macvtap-sysfs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dir, "wlan0", "wireless"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(dir, "eth0"), 0755)).To(Succeed())
+		origSysClassNet = sysClassNet
+		sysClassNet = dir
+	})
+	AfterEach(func() {
+		os.RemoveAll(sysClassNet)
+		sysClassNet = origSysClassNet
+	})
+
+	It("accepts a wired NIC and a tap device", func() {
+		Expect(validateMasterKind(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", EncapType: "ether"}})).To(Succeed())
+		Expect(validateMasterKind(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "tap0", EncapType: "ether"}, LinkType: "tun"})).To(Succeed())
+	})
+	It("rejects a wireless device", func() {
+		err := validateMasterKind(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "wlan0", EncapType: "ether"}})
+		Expect(err).To(MatchError(ContainSubstring("cannot parent on the wireless device \"wlan0\"")))
+	})
+	It("rejects tun, loopback and macvlan devices", func() {
+		Expect(validateMasterKind(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: "tun0", EncapType: "none"}, LinkType: "tun"})).NotTo(Succeed())
+		Expect(validateMasterKind(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", EncapType: "loopback"}})).NotTo(Succeed())
+		Expect(validateMasterKind(&netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "mv0"}})).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("vlan parent", func() {
+	It("names the vlan after its master", func() {
+		Expect(vlanName("bond0", 300)).To(Equal("bond0.300"))
+		Expect(len(vlanName("averylongname01", 4094))).To(Equal(maxIfNameLen))
+	})
+	It("requires a master", func() {
+		_, _, err := LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"deviceID": "vtap0",
+			"vlan": 300
+		}`))
+		Expect(err).To(MatchError(`"vlan" requires the "master" attribute`))
+	})
+})
+
+var _ = Describe("address families", func() {
+	It("refuses to disable both families", func() {
+		_, _, err := LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"enableIPv4": false,
+			"enableIPv6": false
+		}`))
+		Expect(err).To(MatchError(`"enableIPv4" and "enableIPv6" cannot both be false`))
+	})
+})
+
+var _ = Describe("vrf", func() {
+	It("allocates the table after the ones used by other VRFs", func() {
+		Expect(freeVrfTable(nil)).To(Equal(uint32(1)))
+		Expect(freeVrfTable([]netlink.Link{
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}},
+			&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "red"}, Table: 10},
+			&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "blue"}, Table: 3},
+		})).To(Equal(uint32(11)))
+	})
+	It("requires a vrf name with a vrf table", func() {
+		_, _, err := LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"vrfTable": 10
+		}`))
+		Expect(err).To(MatchError(`"vrfTable" requires the "vrf" attribute`))
+	})
+})
+
+var _ = Describe("MAC OUI", func() {
+	It("replaces the prefix of a MAC address", func() {
+		oui, err := parseMacOUI("52:54:00")
+		Expect(err).NotTo(HaveOccurred())
+		mac, err := net.ParseMAC("0a:59:00:dc:6a:e0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(withOUI(mac, oui).String()).To(Equal("52:54:00:dc:6a:e0"))
+		Expect(mac.String()).To(Equal("0a:59:00:dc:6a:e0"))
+	})
+	It("rejects malformed and multicast prefixes", func() {
+		_, err := parseMacOUI("52:54")
+		Expect(err).To(HaveOccurred())
+		_, err = parseMacOUI("01:00:5e")
+		Expect(err).To(MatchError(ContainSubstring("must be a unicast prefix")))
+	})
+})
+
+var _ = Describe("link locks", func() {
+	var origLinkLockDir string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "macvtap-link-locks")
+		Expect(err).NotTo(HaveOccurred())
+		origLinkLockDir = linkLockDir
+		linkLockDir = dir
+	})
+	AfterEach(func() {
+		os.RemoveAll(linkLockDir)
+		linkLockDir = origLinkLockDir
+	})
+
+	It("serializes the holders of the lock of a link", func() {
+		unlock, err := lockLink("eth0")
+		Expect(err).NotTo(HaveOccurred())
+
+		locked := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+
+			unlock, err := lockLink("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			close(locked)
+			unlock()
+		}()
+
+		Consistently(locked, 100*time.Millisecond).ShouldNot(BeClosed())
+		unlock()
+		Eventually(locked).Should(BeClosed())
+	})
+	It("does not block on the lock of another link", func() {
+		unlock, err := lockLink("eth0")
+		Expect(err).NotTo(HaveOccurred())
+		defer unlock()
+
+		otherUnlock, err := lockLink("eth1")
+		Expect(err).NotTo(HaveOccurred())
+		otherUnlock()
+	})
+})
+
+var _ = Describe("tap device provisioning", func() {
+	It("validates the provisioning mode and timeout", func() {
+		Expect(validateTapDeviceProvisioning(&NetConf{})).To(Succeed())
+		Expect(validateTapDeviceProvisioning(&NetConf{TapDeviceProvisioning: "wait-devtmpfs", TapDeviceTimeout: "2s"})).To(Succeed())
+		Expect(validateTapDeviceProvisioning(&NetConf{TapDeviceProvisioning: "mknod"})).NotTo(Succeed())
+		Expect(validateTapDeviceProvisioning(&NetConf{TapDeviceProvisioning: "wait-devtmpfs", TapDeviceTimeout: "-1s"})).NotTo(Succeed())
+	})
+	It("defaults the wait timeout", func() {
+		timeout, err := parseTapDeviceTimeout(&NetConf{TapDeviceProvisioning: "wait-devtmpfs"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timeout).To(Equal(defaultTapDeviceTimeout))
+	})
+})
+
+var _ = Describe("netdev group", func() {
+	It("reads the netdev group of a link", func() {
+		link, err := netlink.LinkByName("lo")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(linkGroup(link)).To(Equal(uint32(0)))
+	})
+})
+
+var _ = Describe("handoff metadata", func() {
+	It("reads the GSO limits of a link", func() {
+		link, err := netlink.LinkByName("lo")
+		Expect(err).NotTo(HaveOccurred())
+		maxSize, maxSegs, err := linkGSO(link)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(maxSize).To(BeNumerically(">", 0))
+		Expect(maxSegs).To(BeNumerically(">", 0))
+	})
+	It("falls back to the default vnet header size", func() {
+		f, err := ioutil.TempFile("", "tap")
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		defer os.Remove(f.Name())
+
+		Expect(tapVnetHdrSize(f.Name())).To(Equal(defaultVnetHdrSize))
+		Expect(tapVnetHdrSize(f.Name() + "-missing")).To(Equal(defaultVnetHdrSize))
+	})
+	It("reports whether vhost-net is accessible", func() {
+		origVhostNetPath := vhostNetPath
+		defer func() { vhostNetPath = origVhostNetPath }()
+
+		f, err := ioutil.TempFile("", "vhost-net")
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		defer os.Remove(f.Name())
+
+		vhostNetPath = f.Name()
+		Expect(vhostNetAvailable()).To(BeTrue())
+		vhostNetPath = f.Name() + "-missing"
+		Expect(vhostNetAvailable()).To(BeFalse())
+	})
+})
+
+var _ = Describe("interrupted ADD", func() {
+	It("refuses network names that would escape the state dir", func() {
+		for _, name := range []string{"../mynet", "my/net", ".."} {
+			_, _, err := LoadConf([]byte(fmt.Sprintf(`{"cniVersion": "0.3.1", "name": %q, "type": "macvtap", "master": "eth0"}`, name)))
+			Expect(err).To(MatchError(fmt.Sprintf("invalid network name %q", name)))
+		}
+	})
+	It("keeps the marker up to date with the links created", func() {
+		dir, err := ioutil.TempDir("", "in-progress")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		currentNS, err := ns.GetCurrentNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer currentNS.Close()
+
+		Expect(beginAdd(dir, "mynet", "cid", "eth0", "/var/run/netns/test", currentNS)).To(Succeed())
+		trackLink("", "veth1234")
+		trackLink("veth1234", "eth0")
+		trackLink("", "eth0-1")
+
+		data, err := ioutil.ReadFile(inProgressPath(dir, "mynet", "cid", "eth0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"netns":"/var/run/netns/test","links":["eth0","eth0-1"]}`))
+
+		endAdd()
+		Expect(inProgressPath(dir, "mynet", "cid", "eth0")).NotTo(BeAnExistingFile())
+	})
+	It("drops the marker of an ADD whose netns is gone", func() {
+		dir, err := ioutil.TempDir("", "in-progress")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		currentNS, err := ns.GetCurrentNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer currentNS.Close()
+
+		Expect(beginAdd(dir, "mynet", "cid", "eth0", filepath.Join(dir, "missing-netns"), currentNS)).To(Succeed())
+		trackLink("", "eth0")
+		path := inProgressPath(dir, "mynet", "cid", "eth0")
+		// the ADD still runs and holds the lock on its marker
+		Expect(cleanupInterruptedAdd(path)).To(Succeed())
+		Expect(path).To(BeAnExistingFile())
+
+		// simulate a killed ADD: the marker stays behind, unlocked
+		currentAdd.file.Close()
+		currentAdd = nil
+
+		Expect(path).To(BeAnExistingFile())
+		Expect(cleanupInterruptedAdd(path)).To(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+		Expect(cleanupInterruptedAdd(path)).To(Succeed())
+	})
+	It("persists no fd reference, and the pid one with the netns inode", func() {
+		dir, err := ioutil.TempDir("", "in-progress")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		currentNS, err := ns.GetCurrentNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer currentNS.Close()
+		inode, err := netnsInode(currentNS)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(beginAdd(dir, "mynet", "cid", "eth0", "fd:3", currentNS)).To(Succeed())
+		data, err := ioutil.ReadFile(inProgressPath(dir, "mynet", "cid", "eth0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(fmt.Sprintf(`{"netnsInode":%d,"links":null}`, inode)))
+		endAdd()
+
+		pidRef := fmt.Sprintf("pid:%d", os.Getpid())
+		Expect(beginAdd(dir, "mynet", "cid", "eth0", pidRef, currentNS)).To(Succeed())
+		data, err = ioutil.ReadFile(inProgressPath(dir, "mynet", "cid", "eth0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(fmt.Sprintf(`{"netns":%q,"netnsInode":%d,"links":null}`, pidRef, inode)))
+		endAdd()
+	})
+})
+
+var _ = Describe("netns references", func() {
+	It("resolves pid and fd references to procfs paths", func() {
+		Expect(ResolveNetns("/var/run/netns/test")).To(Equal("/var/run/netns/test"))
+		Expect(ResolveNetns("pid:1234")).To(Equal("/proc/1234/ns/net"))
+		Expect(ResolveNetns("fd:3")).To(Equal("/proc/self/fd/3"))
+	})
+	It("only resolves a persisted reference still pointing to the same netns", func() {
+		currentNS, err := ns.GetCurrentNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer currentNS.Close()
+		inode, err := netnsInode(currentNS)
+		Expect(err).NotTo(HaveOccurred())
+		pidRef := fmt.Sprintf("pid:%d", os.Getpid())
+
+		Expect(resolvePersistentNetns(pidRef, inode)).To(Equal(fmt.Sprintf("/proc/%d/ns/net", os.Getpid())))
+		Expect(resolvePersistentNetns(pidRef, inode+1)).To(BeEmpty())
+		Expect(resolvePersistentNetns("pid:999999999", inode)).To(BeEmpty())
+		Expect(resolvePersistentNetns("", inode)).To(BeEmpty())
+		Expect(resolvePersistentNetns("/var/run/netns/test", 0)).To(Equal("/var/run/netns/test"))
+	})
+	It("rejects malformed references", func() {
+		for _, ref := range []string{"pid:", "pid:0", "pid:-1", "pid:abc", "fd:", "fd:x"} {
+			_, err := ResolveNetns(ref)
+			Expect(err).To(MatchError(fmt.Sprintf("invalid netns reference %q", ref)))
+		}
+	})
+})
+
+var _ = Describe("failure file", func() {
+	It("records the failed step and the rollback until cleared", func() {
+		dir, err := ioutil.TempDir("", "failures")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		resetFailure()
+		setStep("set-mac")
+		recordRollback("deleted %s", "eth0")
+		Expect(writeFailure(dir, "cid", "eth0", syscall.ENODEV)).To(Succeed())
+
+		f, err := ReadFailure(dir, "cid", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Step).To(Equal("set-mac"))
+		Expect(f.Error).To(Equal("no such device"))
+		Expect(f.Rollback).To(Equal([]string{"deleted eth0"}))
+
+		Expect(ClearFailure(dir, "cid", "eth0")).To(Succeed())
+		Expect(ReadFailure(dir, "cid", "eth0")).To(BeNil())
+		Expect(ClearFailure(dir, "cid", "eth0")).To(Succeed())
+	})
+	It("is only written when a failures dir is configured", func() {
+		Expect(writeFailure("", "cid", "eth0", syscall.ENODEV)).To(Succeed())
+	})
+	It("is not read from the working directory when no failures dir is configured", func() {
+		dir, err := ioutil.TempDir("", "cwd")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		cwd, err := os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+		defer os.Chdir(cwd)
+		Expect(ioutil.WriteFile("cid-eth0.json", []byte("garbage"), 0644)).To(Succeed())
+
+		f, err := ReadFailure("", "cid", "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f).To(BeNil())
+	})
+})
+
+var _ = Describe("result file", func() {
+	It("needs a single placeholder in the file name", func() {
+		Expect(validateResultFile("/run/macvtap/results/%s.json")).To(Succeed())
+		Expect(validateResultFile("/run/macvtap/results.json")).NotTo(Succeed())
+		Expect(validateResultFile("/run/macvtap/%s/%s.json")).NotTo(Succeed())
+		Expect(validateResultFile("/run/macvtap/%s/result.json")).NotTo(Succeed())
+		Expect(validateResultFile("/run/macvtap/%d-%s.json")).NotTo(Succeed())
+	})
+	It("holds the result in the configured version until removed", func() {
+		dir, err := ioutil.TempDir("", "results")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		template := filepath.Join(dir, "results", "%s.json")
+		result := &current.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*current.Interface{{Name: "eth0", Mac: macAddress, Sandbox: "/var/run/netns/test"}},
+		}
+		Expect(writeResultFile(template, "cid", "eth0", result, "0.3.1")).To(Succeed())
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "results", "cid-eth0.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(fmt.Sprintf(`{
+			"cniVersion": "0.3.1",
+			"interfaces": [{"name": "eth0", "mac": "%s", "sandbox": "/var/run/netns/test"}],
+			"dns": {}
+		}`, macAddress)))
+
+		Expect(removeResultFile(template, "cid", "eth0")).To(Succeed())
+		Expect(filepath.Join(dir, "results", "cid-eth0.json")).NotTo(BeAnExistingFile())
+		Expect(removeResultFile(template, "cid", "eth0")).To(Succeed())
+	})
+	It("garbage collects only the stale result files", func() {
+		dir, err := ioutil.TempDir("", "results")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		for _, name := range []string{"result-live-eth0.json", "result-gone-eth0.json", "other.json"} {
+			Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644)).To(Succeed())
+		}
+		template := filepath.Join(dir, "result-%s.json")
+		Expect(removeStaleResultFiles(template, map[string]bool{"live-eth0.json": true})).To(Succeed())
+
+		Expect(filepath.Join(dir, "result-live-eth0.json")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "result-gone-eth0.json")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dir, "other.json")).To(BeAnExistingFile())
+	})
+	It("only garbage collects result files kept in a directory named after the network", func() {
+		Expect(resultFileScoped("/run/macvtap/mynet/%s.json", "mynet")).To(BeTrue())
+		Expect(resultFileScoped("/run/mynet/results/%s.json", "mynet")).To(BeTrue())
+		Expect(resultFileScoped("/run/macvtap/results/mynet-%s.json", "mynet")).To(BeFalse())
+		Expect(resultFileScoped("/run/macvtap/mynet2/%s.json", "mynet")).To(BeFalse())
+	})
+})
+
+var _ = Describe("error taxonomy", func() {
+	It("maps each class of failure to its CNI error code", func() {
+		for err, code := range map[error]uint{
+			&ConfigError{fmt.Errorf("bad config")}:       ErrInvalidConfig,
+			&KernelError{syscall.ENODEV}:                 ErrKernel,
+			&NamespaceError{fmt.Errorf("no netns")}:      ErrNamespace,
+			&ConflictError{fmt.Errorf("already exists")}: ErrInterfaceExists,
+		} {
+			cniErr, ok := AsCNIError(err).(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(code))
+			Expect(cniErr.Msg).To(Equal(err.Error()))
+		}
+	})
+	It("leaves other errors alone", func() {
+		rateLimited := &types.Error{Code: ErrTryAgainLater, Msg: "slow down"}
+		Expect(AsCNIError(rateLimited)).To(BeIdenticalTo(rateLimited))
+		Expect(AsCNIError(syscall.ENODEV)).To(Equal(syscall.ENODEV))
+		Expect(AsCNIError(nil)).To(BeNil())
+	})
+	It("classifies rejected devices as configuration errors", func() {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+		Expect(ValidateDeviceType(bridge, nil)).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(ValidateDeviceMode(bridge, "bridge")).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(ValidateDeviceMode(bridge, "nonsense")).To(BeAssignableToTypeOf(&ConfigError{}))
+	})
+	It("only wraps unclassified errors as kernel errors", func() {
+		configErr := &ConfigError{fmt.Errorf("bad config")}
+		rateLimited := &types.Error{Code: ErrTryAgainLater, Msg: "slow down"}
+		Expect(kernelError(configErr)).To(BeIdenticalTo(configErr))
+		Expect(kernelError(rateLimited)).To(BeIdenticalTo(rateLimited))
+		Expect(kernelError(syscall.ENODEV)).To(Equal(&KernelError{syscall.ENODEV}))
+	})
+	It("classifies configuration and netns failures", func() {
+		err := CmdDel(&skel.CmdArgs{StdinData: []byte(`{"cniVersion": "0.4.0"}`)})
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+
+		err = CmdCheck(&skel.CmdArgs{
+			Netns:     "/var/run/netns/missing-netns",
+			IfName:    "eth0",
+			StdinData: []byte(`{"cniVersion": "0.4.0", "name": "mynet", "type": "macvtap", "master": "eth0"}`),
+		})
+		Expect(err).To(BeAssignableToTypeOf(&NamespaceError{}))
+	})
+})
+
+var _ = Describe("deviceID MTU validation", func() {
+	It("rejects a negative MTU or a missing device up front", func() {
+		Expect(ValidateConf(NetConf{DeviceID: "vtap0", MTU: -1})).To(MatchError("invalid MTU -1, must not be negative"))
+		Expect(ValidateConf(NetConf{DeviceID: "missing-vtap", MTU: 1400})).To(MatchError(HavePrefix(`failed to lookup device "missing-vtap"`)))
+		Expect(ValidateConf(NetConf{DeviceID: "missing-vtap"})).To(Succeed())
+	})
+})
+
+var _ = Describe("MAC override policy", func() {
+	It("allows requesting a MAC address by default", func() {
+		conf := &NetConf{}
+		Expect(validateMacOverride(conf, EnvArgs{MAC: macAddress})).To(Succeed())
+	})
+	It("rejects a requested MAC address when the network forbids it", func() {
+		allow := false
+		conf := &NetConf{AllowMacOverride: &allow}
+		conf.Name = "mynet"
+		Expect(validateMacOverride(conf, EnvArgs{MAC: macAddress})).To(MatchError(`network "mynet" does not allow requesting MAC address ` + macAddress))
+		Expect(validateMacOverride(conf, EnvArgs{})).To(Succeed())
+	})
+})
+
+var _ = Describe("CNI_ARGS parsing", func() {
+	It("ignores unknown keys unless asked to fail on them", func() {
+		envArgs, err := parseEnvArgs("K8S_POD_NAMESPACE=default;K8S_POD_NAME=vm;MODE=vepa", true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(envArgs.MODE)).To(Equal("vepa"))
+
+		_, err = parseEnvArgs("K8S_POD_NAMESPACE=default;K8S_POD_NAME=vm;MODE=vepa", false)
+		Expect(err).To(MatchError(ContainSubstring("unknown args")))
+	})
+	It("honors IgnoreUnknown", func() {
+		_, err := parseEnvArgs("IgnoreUnknown=1;K8S_POD_NAME=vm", false)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = parseEnvArgs("IgnoreUnknown=0;K8S_POD_NAME=vm", true)
+		Expect(err).To(MatchError(ContainSubstring("unknown args")))
+	})
+	It("fails CHECK on unknown keys when asked to", func() {
+		err := CmdCheck(&skel.CmdArgs{
+			Netns:     "/var/run/netns/missing-netns",
+			IfName:    "eth0",
+			Args:      "K8S_POD_NAME=vm",
+			StdinData: []byte(`{"cniVersion": "0.4.0", "name": "mynet", "type": "macvtap", "master": "eth0", "failOnUnknownArgs": true}`),
+		})
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(err).To(MatchError(ContainSubstring("unknown args")))
+	})
+})
+
+var _ = Describe("netns thread affinity", func() {
+	netnsInode := func(path string) uint64 {
+		var st syscall.Stat_t
+		Expect(syscall.Stat(path, &st)).To(Succeed())
+		return st.Ino
+	}
+
+	It("runs every netns.Do call in the target netns under scheduler churn", func() {
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		hostInode := netnsInode("/proc/thread-self/ns/net")
+		targetInode := netnsInode(targetNs.Path())
+
+		const calls = 64
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*calls)
+		for i := 0; i < calls; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- targetNs.Do(func(ns.NetNS) error {
+					runtime.Gosched()
+					var st syscall.Stat_t
+					if err := syscall.Stat("/proc/thread-self/ns/net", &st); err != nil {
+						return err
+					}
+					if st.Ino != targetInode {
+						return fmt.Errorf("netns.Do ran in netns %d instead of %d", st.Ino, targetInode)
+					}
+					return nil
+				})
+				// the thread running the goroutine must not have been
+				// left in the target netns
+				var st syscall.Stat_t
+				if err := syscall.Stat("/proc/thread-self/ns/net", &st); err != nil {
+					errs <- err
+				} else if st.Ino != hostInode {
+					errs <- fmt.Errorf("goroutine left in netns %d instead of %d", st.Ino, hostInode)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+})
+
+var _ = Describe("feature gates", func() {
+	var origFeatureGatesFile string
+
+	BeforeEach(func() {
+		resetWarnings()
+		f, err := ioutil.TempFile("", "feature-gates")
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		origFeatureGatesFile = featureGatesFile
+		featureGatesFile = f.Name()
+	})
+	AfterEach(func() {
+		os.Remove(featureGatesFile)
+		featureGatesFile = origFeatureGatesFile
+	})
+
+	It("enables no gate without a file", func() {
+		os.Remove(featureGatesFile)
+		conf := &NetConf{}
+		Expect(applyFeatureGates(conf)).To(Succeed())
+		Expect(conf.DirectCreate).To(BeFalse())
+	})
+	It("turns on the behaviors enabled on the node", func() {
+		Expect(ioutil.WriteFile(featureGatesFile, []byte(`{"DirectCreate": true, "Teleport": true}`), 0644)).To(Succeed())
+		conf := &NetConf{}
+		Expect(applyFeatureGates(conf)).To(Succeed())
+		Expect(conf.DirectCreate).To(BeTrue())
+		Expect(Warnings()).To(ConsistOf(ContainSubstring(`unknown feature gate "Teleport"`)))
+	})
+	It("fails on a malformed file", func() {
+		Expect(ioutil.WriteFile(featureGatesFile, []byte(`{"DirectCreate": "yes"}`), 0644)).To(Succeed())
+		Expect(applyFeatureGates(&NetConf{})).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("warnings", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "macvtap-warnings")
+		Expect(err).NotTo(HaveOccurred())
+		resetWarnings()
+	})
+
+	AfterEach(func() {
+		resetWarnings()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("records warnings and writes them to the warnings dir", func() {
+		warnf("txqlen of %q is %d", "eth0", 0)
+		Expect(Warnings()).To(Equal([]string{`txqlen of "eth0" is 0`}))
+
+		Expect(writeWarnings(dir, "dummy", "net1")).To(Succeed())
+		data, err := ioutil.ReadFile(filepath.Join(dir, "dummy-net1.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["txqlen of \"eth0\" is 0"]`))
+
+		Expect(removeWarnings(dir, "dummy", "net1")).To(Succeed())
+		_, err = os.Stat(filepath.Join(dir, "dummy-net1.json"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+	It("does not write a file when there are no warnings", func() {
+		Expect(writeWarnings(dir, "dummy", "net1")).To(Succeed())
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+		Expect(removeWarnings(dir, "dummy", "net1")).To(Succeed())
+	})
+})
+
+var _ = Describe("add rate limiting", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("rejects invalid limits", func() {
+		Expect(validateRateLimit(&RateLimit{PerSecond: 0, Burst: 1})).NotTo(Succeed())
+		Expect(validateRateLimit(&RateLimit{PerSecond: 1, Burst: 0})).NotTo(Succeed())
+		Expect(validateRateLimit(nil)).To(Succeed())
+	})
+	It("allows a burst, then asks to try again later until tokens refill", func() {
+		limit := &RateLimit{PerSecond: 1, Burst: 2}
+		now := time.Now()
+
+		Expect(takeAddTokens(dir, MASTER_NAME, limit, 1, now)).To(Succeed())
+		Expect(takeAddTokens(dir, MASTER_NAME, limit, 1, now)).To(Succeed())
+
+		err := takeAddTokens(dir, MASTER_NAME, limit, 1, now)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Code).To(Equal(ErrTryAgainLater))
+
+		Expect(takeAddTokens(dir, MASTER_NAME, limit, 1, now.Add(time.Second))).To(Succeed())
+	})
+	It("takes a token per macvtap, or none", func() {
+		limit := &RateLimit{PerSecond: 1, Burst: 2}
+		now := time.Now()
+
+		err := takeAddTokens(dir, MASTER_NAME, limit, 3, now)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Code).To(Equal(ErrTryAgainLater))
+
+		Expect(takeAddTokens(dir, MASTER_NAME, limit, 2, now)).To(Succeed())
+		Expect(takeAddTokens(dir, MASTER_NAME, limit, 1, now)).NotTo(Succeed())
+	})
+	It("keeps a separate bucket per master", func() {
+		limit := &RateLimit{PerSecond: 1, Burst: 1}
+		now := time.Now()
+
+		Expect(takeAddTokens(dir, "eth1", limit, 1, now)).To(Succeed())
+		Expect(takeAddTokens(dir, "eth2", limit, 1, now)).To(Succeed())
+		Expect(takeAddTokens(dir, "eth1", limit, 1, now)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("port isolation", func() {
+	It("rejects port rules with an invalid protocol or port", func() {
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"blockedPorts": [{"protocol": "icmp", "port": 22}]
+		}`, MASTER_NAME)
+		_, _, err := LoadConf([]byte(conf))
+		Expect(err).To(HaveOccurred())
+
+		Expect(validatePortRules([]PortRule{{Protocol: "tcp", Port: 70000}})).NotTo(Succeed())
+	})
+	It("renders blocked and allowed ports scoped to the interface", func() {
+		ruleset := renderPortRules("net1",
+			[]PortRule{{Protocol: "tcp", Port: 22}},
+			[]PortRule{{Protocol: "udp", Port: 53}})
+		Expect(ruleset).To(ContainSubstring("table inet macvtap-net1 {"))
+		Expect(ruleset).To(ContainSubstring(`iifname "net1" udp dport 53 drop`))
+		Expect(ruleset).To(ContainSubstring(`iifname "net1" tcp dport 22 accept`))
+		Expect(ruleset).To(ContainSubstring(`iifname "net1" meta l4proto { tcp, udp } drop`))
+	})
+	It("accepts replies to connections opened from the container first", func() {
+		ruleset := renderPortRules("net1", []PortRule{{Protocol: "tcp", Port: 22}}, nil)
+		established := strings.Index(ruleset, `iifname "net1" ct state established,related accept`)
+		Expect(established).To(BeNumerically(">=", 0))
+		Expect(established).To(BeNumerically("<", strings.Index(ruleset, "l4proto")))
+	})
+	It("refuses port rules when the tap device is consumed", func() {
+		for _, consumer := range []string{`"handoffDir": "/run/macvtap-handoff"`, `"tapDeviceProvisioning": "wait-devtmpfs"`} {
+			_, _, err := LoadConf([]byte(fmt.Sprintf(`{
+    			"cniVersion": "0.3.1",
+    			"name": "mynet",
+    			"type": "macvtap",
+    			"master": "%s",
+    			"allowedPorts": [{"protocol": "tcp", "port": 22}],
+    			%s
+			}`, MASTER_NAME, consumer)))
+			Expect(err).To(MatchError(ContainSubstring("only filter traffic of netdev consumers")))
+		}
+	})
+	It("does not drop unlisted ports when only blocked ports are given", func() {
+		ruleset := renderPortRules("net1", nil, []PortRule{{Protocol: "tcp", Port: 25}})
+		Expect(ruleset).NotTo(ContainSubstring("l4proto"))
+	})
+})
+
+var _ = Describe("multiple interfaces", func() {
+	It("names additional interfaces after the requested one", func() {
+		names, err := interfaceNames("net1", 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{"net1", "net1-1", "net1-2"}))
+
+		names, err = interfaceNames("net1", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{"net1"}))
+	})
+	It("rejects more interfaces than allowed as a configuration error", func() {
+		conf := `{"cniVersion": "0.3.1", "name": "mynet", "type": "macvtap", "master": "eth0", "interfaces": %d}`
+		_, _, err := LoadConf([]byte(fmt.Sprintf(conf, maxInterfaces)))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = CmdAdd(&skel.CmdArgs{
+			ContainerID: "dummy",
+			IfName:      "net1",
+			StdinData:   []byte(fmt.Sprintf(conf, 1000)),
+		})
+		Expect(err).To(BeAssignableToTypeOf(&ConfigError{}))
+		Expect(err).To(MatchError(ContainSubstring(`"interfaces" must be at most 16`)))
+	})
+	It("rejects a requested name longer than the kernel allows", func() {
+		_, err := interfaceNames("averylongname012", 1)
+		Expect(err).To(HaveOccurred())
+	})
+	It("shortens additional names that would not fit", func() {
+		names, err := interfaceNames("averylongname0", 12)
+		Expect(err).NotTo(HaveOccurred())
+		for _, name := range names {
+			Expect(len(name)).To(BeNumerically("<=", maxIfNameLen))
+		}
+		Expect(names[1]).To(MatchRegexp(`^averylong[0-9a-f]{4}-1$`))
+		Expect(names[11]).To(MatchRegexp(`^averylon[0-9a-f]{4}-11$`))
+
+		again, err := interfaceNames("averylongname0", 12)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(names))
+
+		other, err := interfaceNames("averylongname1", 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other[1]).NotTo(Equal(names[1]))
+	})
+	It("derives distinct MAC addresses from the requested one", func() {
+		mac, err := net.ParseMAC("0a:59:00:dc:6a:ff")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offsetMAC(mac, 0).String()).To(Equal("0a:59:00:dc:6a:ff"))
+		Expect(offsetMAC(mac, 1).String()).To(Equal("0a:59:00:dc:6b:00"))
+		Expect(mac.String()).To(Equal("0a:59:00:dc:6a:ff"))
+	})
+	It("cannot create several interfaces from a single deviceID", func() {
+		_, _, err := LoadConf([]byte(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"deviceID": "vtap0",
+    		"interfaces": 2
+		}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("readiness gate", func() {
+	It("validates the timeout", func() {
+		_, err := parseWaitReadyTimeout(&WaitReady{Timeout: "2s"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = parseWaitReadyTimeout(&WaitReady{Timeout: "soon"})
+		Expect(err).To(HaveOccurred())
+		_, err = parseWaitReadyTimeout(&WaitReady{Timeout: "0s"})
+		Expect(err).To(HaveOccurred())
+	})
+	It("does not consider a link that is down as ready", func() {
+		link := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "vtap0", OperState: netlink.OperDown}}}
+		ready, err := linkReady(link)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeFalse())
+	})
+})
+
+var _ = Describe("hooks", func() {
+	BeforeEach(func() {
+		resetWarnings()
+	})
+
+	It("requires exactly one of exec or url", func() {
+		Expect(validateHooks(&Hooks{PostAdd: []Hook{{Exec: "/bin/true"}}})).To(Succeed())
+		Expect(validateHooks(&Hooks{PostDel: []Hook{{}}})).NotTo(Succeed())
+		Expect(validateHooks(&Hooks{PostDel: []Hook{{Exec: "/bin/true", URL: "http://localhost"}}})).NotTo(Succeed())
+	})
+	It("POSTs the event to URL hooks", func() {
+		var received HookEvent
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+		}))
+		defer server.Close()
+
+		runHooks([]Hook{{URL: server.URL}}, HookEvent{Event: "postAdd", ContainerID: "dummy", IfName: "net1"})
+		Expect(Warnings()).To(BeEmpty())
+		Expect(received.Event).To(Equal("postAdd"))
+		Expect(received.ContainerID).To(Equal("dummy"))
+	})
+	It("reports failing hooks as warnings", func() {
+		runHooks([]Hook{{Exec: "/nonexistent/hook"}}, HookEvent{Event: "postDel"})
+		Expect(Warnings()).To(HaveLen(1))
+	})
+	It("reports the netns reference of DEL as passed by the runtime", func() {
+		dir, err := ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		var received HookEvent
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+		}))
+		defer server.Close()
+
+		pidRef := fmt.Sprintf("pid:%d", os.Getpid())
+		err = CmdDel(&skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       pidRef,
+			IfName:      "mvtap-nohook0",
+			StdinData: []byte(fmt.Sprintf(`{
+    "cniVersion": "0.4.0",
+    "name": "mynet",
+    "type": "macvtap",
+    "master": "eth0",
+    "stateDir": %q,
+    "hooks": {"postDel": [{"url": %q}]}
+}`, dir, server.URL)),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(received.Event).To(Equal("postDel"))
+		Expect(received.Netns).To(Equal(pidRef))
+	})
+})
+
+var _ = Describe("status", func() {
+	It("reports the plugin as not available when the master is missing", func() {
+		dir, err := ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		err = CmdStatus([]byte(fmt.Sprintf(`{
+    		"cniVersion": "0.4.0",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "missing0",
+    		"stateDir": "%s"
+		}`, dir)))
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*types.Error).Code).To(Equal(ErrPluginNotAvailable))
+	})
+})
+
+var _ = Describe("legacy results", func() {
+	// the wire format legacy runtimes parse, pinned so that bumping the CNI
+	// libraries cannot silently change it
+	result := func() *current.Result {
+		return &current.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*current.Interface{
+				{Name: "eth0", Mac: "0a:58:0a:f4:00:01", Sandbox: "/var/run/netns/test"},
+				{Name: "eth0-1", Mac: "0a:58:0a:f4:00:02", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{{
+				Version:   "4",
+				Interface: current.Int(1),
+				Address:   net.IPNet{IP: net.ParseIP("10.244.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+				Gateway:   net.ParseIP("10.244.0.1"),
+			}},
+		}
+	}
+
+	for _, ver := range []string{"0.3.0", "0.3.1"} {
+		ver := ver
+		It(fmt.Sprintf("keeps every interface and IP in a %s result", ver), func() {
+			legacy, err := result().GetAsVersion(ver)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := json.Marshal(legacy)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"interfaces": [
+					{"name": "eth0", "mac": "0a:58:0a:f4:00:01", "sandbox": "/var/run/netns/test"},
+					{"name": "eth0-1", "mac": "0a:58:0a:f4:00:02", "sandbox": "/var/run/netns/test"}
+				],
+				"ips": [
+					{"version": "4", "interface": 1, "address": "10.244.0.2/24", "gateway": "10.244.0.1"}
+				],
+				"dns": {}
+			}`, ver)))
+		})
+	}
+	It("keeps the first IP of a 0.2.0 result", func() {
+		legacy, err := result().GetAsVersion("0.2.0")
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(legacy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"cniVersion": "0.2.0",
+			"ip4": {"ip": "10.244.0.2/24", "gateway": "10.244.0.1"},
+			"dns": {}
+		}`))
+	})
+	It("drops the IP version from a 1.x result", func() {
+		data, err := encodeResult(result(), "1.1.0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"cniVersion": "1.1.0",
+			"interfaces": [
+				{"name": "eth0", "mac": "0a:58:0a:f4:00:01", "sandbox": "/var/run/netns/test"},
+				{"name": "eth0-1", "mac": "0a:58:0a:f4:00:02", "sandbox": "/var/run/netns/test"}
+			],
+			"ips": [
+				{"interface": 1, "address": "10.244.0.2/24", "gateway": "10.244.0.1"}
+			],
+			"dns": {}
+		}`))
+	})
+	It("parses a 1.x prevResult", func() {
+		n, _, err := LoadConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [{"name": "net1", "sandbox": "/var/run/netns/test"}],
+				"ips": [{"interface": 0, "address": "fd00::2/64"}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		prevResult, err := current.NewResultFromResult(n.PrevResult)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prevResult.Interfaces[0].Name).To(Equal("net1"))
+		Expect(prevResult.IPs[0].Version).To(Equal("6"))
+	})
+})
+
+var _ = Describe("configuration digest", func() {
+	It("changes with the network configuration only", func() {
+		digest, err := ConfigDigest([]byte(`{"name": "mynet", "type": "macvtap", "master": "eth0", "mode": "bridge"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		sameDigest, err := ConfigDigest([]byte(`{
+			"mode": "bridge",
+			"master": "eth0",
+			"type": "macvtap",
+			"name": "mynet",
+			"prevResult": {"cniVersion": "0.4.0", "interfaces": [{"name": "net1"}]}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sameDigest).To(Equal(digest))
+
+		otherDigest, err := ConfigDigest([]byte(`{"name": "mynet", "type": "macvtap", "master": "eth0", "mode": "vepa"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(otherDigest).NotTo(Equal(digest))
+	})
+	It("round-trips through the link alias", func() {
+		alias, ok := parseLinkAlias(linkAlias{Digest: "0123456789abcdef"}.String())
+		Expect(ok).To(BeTrue())
+		Expect(alias.Digest).To(Equal("0123456789abcdef"))
+		Expect(alias.Description).To(BeEmpty())
+
+		alias, ok = parseLinkAlias(linkAlias{Digest: "0123456789abcdef", Description: "storage vlan210 digest=x"}.String())
+		Expect(ok).To(BeTrue())
+		Expect(alias.Digest).To(Equal("0123456789abcdef"))
+		Expect(alias.Description).To(Equal("storage vlan210 digest=x"))
+
+		_, ok = parseLinkAlias("uplink to switch 3")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("description", func() {
+	It("must fit in the link alias and be printable", func() {
+		Expect(validateDescription("storage-vlan210")).To(Succeed())
+		Expect(validateDescription(strings.Repeat("x", maxDescriptionLen+1))).To(MatchError("description is 129 bytes long, must be at most 128"))
+		Expect(validateDescription("storage\nvlan")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("configuration schema", func() {
+	It("agrees with the checks of LoadConf on boundary values", func() {
+		for field, values := range map[string][]string{
+			"description":           {strings.Repeat("x", maxDescriptionLen), strings.Repeat("x", maxDescriptionLen+1)},
+			"tapDeviceProvisioning": {"", tapProvisioningNone, tapProvisioningWaitDevtmpfs, "mknod"},
+		} {
+			for _, value := range values {
+				goErr := validateDescription(value)
+				if field == "tapDeviceProvisioning" {
+					goErr = validateTapDeviceProvisioning(&NetConf{TapDeviceProvisioning: value})
+				}
+				data, err := json.Marshal(map[string]string{field: value})
+				Expect(err).NotTo(HaveOccurred())
+				schemaErr := validateAgainstSchema(data)
+				Expect(schemaErr == nil).To(Equal(goErr == nil), "%s %q: schema %v, LoadConf %v", field, value, schemaErr, goErr)
+			}
+		}
+	})
+})
+
+var _ = Describe("mode override", func() {
+	It("keeps the configured mode when no override is requested", func() {
+		conf := &NetConf{Mode: "vepa"}
+		Expect(ApplyModeOverride(conf, EnvArgs{})).To(Succeed())
+		Expect(conf.Mode).To(Equal("vepa"))
+	})
+	It("prefers the runtimeConfig mode over the CNI_ARGS mode", func() {
+		conf := &NetConf{Mode: "vepa"}
+		conf.RuntimeConfig.Mode = "private"
+		Expect(ApplyModeOverride(conf, EnvArgs{MODE: "bridge"})).To(Succeed())
+		Expect(conf.Mode).To(Equal("private"))
+	})
+	It("rejects an unknown mode", func() {
+		conf := &NetConf{}
+		Expect(ApplyModeOverride(conf, EnvArgs{MODE: "nope"})).NotTo(Succeed())
+	})
+	It("applies the args.cni mode below the CNI_ARGS one", func() {
+		conf := &NetConf{Mode: "vepa"}
+		conf.Args.CNI.Mode = "private"
+		Expect(ApplyModeOverride(conf, EnvArgs{})).To(Succeed())
+		Expect(conf.Mode).To(Equal("private"))
+
+		conf = &NetConf{Mode: "vepa"}
+		conf.Args.CNI.Mode = "private"
+		Expect(ApplyModeOverride(conf, EnvArgs{MODE: "bridge"})).To(Succeed())
+		Expect(conf.Mode).To(Equal("bridge"))
+	})
+	It("applies the args.cni MAC address and MTU", func() {
+		conf, _, err := LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"mtu": 1500,
+			"args": {"cni": {"mac": "0a:59:00:dc:6a:e0", "mtu": 1400}}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		envArgs := EnvArgs{}
+		applyArgsCNI(conf, &envArgs)
+		Expect(string(envArgs.MAC)).To(Equal("0a:59:00:dc:6a:e0"))
+		Expect(conf.MTU).To(Equal(1400))
+
+		envArgs = EnvArgs{MAC: "0a:59:00:dc:6a:e1"}
+		applyArgsCNI(conf, &envArgs)
+		Expect(string(envArgs.MAC)).To(Equal("0a:59:00:dc:6a:e1"))
+	})
+	It("reports a mode mismatch on an imported device", func() {
+		link := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "vtap0"}, Mode: netlink.MACVLAN_MODE_VEPA}}
+		Expect(ValidateDeviceMode(link, "vepa")).To(Succeed())
+		Expect(ValidateDeviceMode(link, "bridge")).NotTo(Succeed())
+		Expect(ValidateDeviceMode(link, "")).To(Succeed())
+	})
+})
+
+var _ = Describe("macvtap Operations", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// Add master
+			err = netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: MASTER_NAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+	})
+
+	It("resolves a renamed master by its ifindex or MAC address", func() {
+		// pretend the dummy master is a physical NIC
+		origSysClassNet := sysClassNet
+		defer func() { sysClassNet = origSysClassNet }()
+		var err error
+		sysClassNet, err = ioutil.TempDir("", "sys-class-net")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(sysClassNet)
+		Expect(os.MkdirAll(filepath.Join(sysClassNet, MASTER_NAME, "device"), 0755)).To(Succeed())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := &NetConf{Master: "renamed0", MasterIndex: master.Attrs().Index}
+			Expect(resolveMaster(conf)).To(Succeed())
+			Expect(conf.Master).To(Equal(MASTER_NAME))
+
+			conf = &NetConf{Master: "renamed0", MasterMAC: master.Attrs().HardwareAddr.String()}
+			Expect(resolveMaster(conf)).To(Succeed())
+			Expect(conf.Master).To(Equal(MASTER_NAME))
+
+			conf = &NetConf{Master: "renamed0", MasterIndex: master.Attrs().Index, MasterMAC: master.Attrs().HardwareAddr.String()}
+			Expect(resolveMaster(conf)).To(Succeed())
+			Expect(conf.Master).To(Equal(MASTER_NAME))
+
+			conf = &NetConf{Master: "renamed0"}
+			Expect(resolveMaster(conf)).NotTo(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("refuses a reused ifindex or a MAC address only virtual links carry", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := &NetConf{Master: "renamed0", MasterIndex: master.Attrs().Index, MasterMAC: "02:00:00:00:00:01"}
+			_, err = findMaster(conf)
+			Expect(err).To(MatchError(ContainSubstring("whose MAC address is not 02:00:00:00:00:01")))
+
+			// a VLAN shares the MAC address of the master, and neither has a
+			// permanent one or a device
+			Expect(netlink.LinkAdd(&netlink.Vlan{
+				LinkAttrs: netlink.LinkAttrs{Name: MASTER_NAME + ".10", ParentIndex: master.Attrs().Index},
+				VlanId:    10,
+			})).To(Succeed())
+			conf = &NetConf{Master: "renamed0", MasterMAC: master.Attrs().HardwareAddr.String()}
+			_, err = findMaster(conf)
+			Expect(err).To(MatchError(ContainSubstring("no link with hardware address")))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("only removes the unused VRFs it created", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "admin"}, Table: 100})).To(Succeed())
+			Expect(removeVrfIfUnused("admin")).To(Succeed())
+			_, err := netlink.LinkByName("admin")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ensureVrf("owned", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removeVrfIfUnused("owned")).To(Succeed())
+			_, err = netlink.LinkByName("owned")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("tells a tun master from a tap one as read back from the kernel", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for name, mode := range map[string]netlink.TuntapMode{"tun0": netlink.TUNTAP_MODE_TUN, "tap0": netlink.TUNTAP_MODE_TAP} {
+				Expect(netlink.LinkAdd(&netlink.Tuntap{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					Mode:      mode,
+				})).To(Succeed())
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				if mode == netlink.TUNTAP_MODE_TUN {
+					Expect(validateMasterKind(link)).To(MatchError(ContainSubstring("cannot parent on the tun device")))
+				} else {
+					Expect(validateMasterKind(link)).To(Succeed())
+				}
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("applies the requested ARP sysctls to a created macvtap", func() {
+		arpNotify := true
+		dropGratuitousArp := false
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master:            MASTER_NAME,
+			Mode:              "bridge",
+			ArpNotify:         &arpNotify,
+			DropGratuitousArp: &dropGratuitousArp,
+		}
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := CreateMacvtap(conf, "foobar0", targetNs)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			value, err := sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceArpNotifySysctlTemplate, "foobar0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+			value, err = sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceDropGratuitousArpSysctlTemplate, "foobar0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("validates the MTU of an imported device against its lower device", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMTU(master, 1500)).To(Succeed())
+			Expect(netlink.LinkAdd(&netlink.Macvtap{
+				Macvlan: netlink.Macvlan{
+					LinkAttrs: netlink.LinkAttrs{
+						Name:        "vtap0",
+						ParentIndex: master.Attrs().Index,
+					},
+					Mode: netlink.MACVLAN_MODE_BRIDGE,
+				},
+			})).To(Succeed())
+
+			Expect(ValidateConf(NetConf{DeviceID: "vtap0", MTU: 1400})).To(Succeed())
+			Expect(ValidateConf(NetConf{DeviceID: "vtap0", MTU: 9000})).To(MatchError(`invalid MTU 9000, must be [0, lower device MTU(1500)] of "vtap0"`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("silences the disabled address families", func() {
+		enable := false
+		conf := &NetConf{EnableIPv4: &enable, EnableIPv6: &enable}
+		Expect(configureAddressFamilies(conf, MASTER_NAME, originalNS)).To(Succeed())
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			value, err := sysctl.Sysctl(fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, MASTER_NAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("8"))
+			value, err = sysctl.Sysctl(fmt.Sprintf(IPv6InterfaceDisableSysctlTemplate, MASTER_NAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("reports the plugin as available when the master exists", func() {
+		dir, err := ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return CmdStatus([]byte(fmt.Sprintf(`{
+    			"cniVersion": "0.4.0",
+    			"name": "mynet",
+    			"type": "macvtap",
+    			"master": "%s",
+    			"stateDir": "%s",
+    			"autoLoadModule": true
+			}`, MASTER_NAME, dir)))
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("creates an macvtap link in a non-default namespace", func() {
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master: MASTER_NAME,
+			Mode:   "bridge",
+			MTU:    1500,
+		}
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := CreateMacvtap(conf, "foobar0", targetNs)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link exists in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal("foobar0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("creates an macvtap link directly with its final name", func() {
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master:       MASTER_NAME,
+			Mode:         "bridge",
+			DirectCreate: true,
+		}
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			iface, err := CreateMacvtap(conf, "foobar0", targetNs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iface.Name).To(Equal("foobar0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("imports an existing macvtap link in a non-default namespace", func() {
+		macvtapIfaceName := "mymacvtap0"
+
+		// create the initial macvtap
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master: MASTER_NAME,
+			Mode:   "bridge",
+		}
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := CreateMacvtap(conf, macvtapIfaceName, originalNS)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		updatedMtu := 1000
+		conf = &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master:   MASTER_NAME,
+			Mode:     "bridge",
+			MTU:      updatedMtu,
+			DeviceID: macvtapIfaceName,
+		}
+
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := ConfigureMacvtap(conf, macvtapIfaceName, targetNs)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link exists with the updated configurations
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(macvtapIfaceName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(macvtapIfaceName))
+			Expect(link.Attrs().MTU).To(Equal(updatedMtu))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("configures an imported macvtap like a created one", func() {
+		createdName := "created0"
+		importedName := "imported0"
+
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master: MASTER_NAME,
+			Mode:   "bridge",
+		}
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := CreateMacvtap(conf, createdName, targetNs)
+			Expect(err).NotTo(HaveOccurred())
+
+			// pre-create the device to import, and mess up its attributes
+			_, err = CreateMacvtap(conf, importedName, originalNS)
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(importedName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetTxQLen(link, 42)).To(Succeed())
+			Expect(netlink.SetPromiscOn(link)).To(Succeed())
+
+			importConf := *conf
+			importConf.Master = ""
+			importConf.DeviceID = importedName
+			_, err = ConfigureMacvtap(&importConf, importedName, targetNs)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			created, err := netlink.LinkByName(createdName)
+			Expect(err).NotTo(HaveOccurred())
+			imported, err := netlink.LinkByName(importedName)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(imported.Attrs().TxQLen).To(Equal(created.Attrs().TxQLen))
+			Expect(imported.Attrs().Promisc).To(Equal(created.Attrs().Promisc))
+			Expect(imported.Attrs().MTU).To(Equal(created.Attrs().MTU))
+			Expect(imported.(*netlink.Macvtap).Mode).To(Equal(created.(*netlink.Macvtap).Mode))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("configures and deconfigures a macvtap link having a user specified mac address with ADD/DEL", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        fmt.Sprintf("MAC=%s", macAddress),
+		}
+
+		// Make sure macvtap link exists in the target namespace
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link exists in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(IFNAME))
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(macAddress))
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNs.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error {
+				return CmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link has been deleted
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			Expect(link).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("configures and deconfigures a macvtap link having an auto-generated mac address with ADD/DEL", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		// Make sure macvtap link exists in the target namespace
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link exists in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(IFNAME))
+			hwAddr := fmt.Sprintf("%s", link.Attrs().HardwareAddr)
+			Expect(hwAddr).NotTo(BeNil())
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNs.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error {
+				return CmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link has been deleted
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			Expect(link).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("configures and deconfigures several macvtap links in a single ADD/DEL", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"interfaces": 2
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        fmt.Sprintf("MAC=%s", macAddress),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure both macvtap links exist in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(macAddress))
+
+			link, err = netlink.LinkByName(IFNAME + "-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("0a:59:00:dc:6a:e1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error {
+				return CmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure both macvtap links have been deleted
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			_, err = netlink.LinkByName(IFNAME + "-1")
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("aligns the macvtap MTU with the interface of the previous result", func() {
+		const IFNAME = "macvt0"
+		const prevIfName = "eth0"
+		const prevMTU = 1400
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{Name: prevIfName, MTU: prevMTU},
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"alignMtuWithPrevResult": true,
+    		"prevResult": {
+    			"cniVersion": "0.3.1",
+    			"interfaces": [{"name": "%s", "sandbox": "%s"}]
+    		}
+		}`, MASTER_NAME, prevIfName, targetNs.Path())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MTU).To(Equal(prevMTU))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("detects configuration drift with CHECK", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.4.0",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+		updatedConf := fmt.Sprintf(`{
+    		"cniVersion": "0.4.0",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"mode": "vepa"
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(CmdCheck(args)).To(Succeed())
+
+			args.StdinData = []byte(updatedConf)
+			Expect(CmdCheck(args)).NotTo(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("writes handoff metadata for the tap consumer on ADD and removes it on DEL", func() {
+		const IFNAME = "macvt0"
+
+		dir, err := ioutil.TempDir("", "macvtap-handoff")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"handoffDir": "%s"
+		}`, MASTER_NAME, dir)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "mynet", "dummy-macvt0.json"))
+		Expect(err).NotTo(HaveOccurred())
+		handoff := Handoff{}
+		Expect(json.Unmarshal(data, &handoff)).To(Succeed())
+		Expect(handoff.IfName).To(Equal(IFNAME))
+		Expect(handoff.TapPath).To(Equal(fmt.Sprintf("/dev/tap%d", handoff.IfIndex)))
+		Expect(handoff.VnetHdrSize).To(Equal(defaultVnetHdrSize))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error {
+				return CmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = os.Stat(filepath.Join(dir, "mynet", "dummy-macvt0.json"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+	It("only reports the planned interfaces when attach is disabled", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"attach": false
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        fmt.Sprintf("MAC=%s", macAddress),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(1))
+			Expect(result.Interfaces[0].Name).To(Equal(IFNAME))
+			Expect(result.Interfaces[0].Mac).To(Equal(macAddress))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure no macvtap link was created
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("creates the macvtap on a vlan of the master, creating the vlan once", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"vlan": 300
+		}`, MASTER_NAME)
+
+		for _, containerID := range []string{"dummy0", "dummy1"} {
+			targetNs, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNs.Close()
+
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNs.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			vlans := 0
+			for _, link := range links {
+				if vlan, ok := link.(*netlink.Vlan); ok && vlan.ParentIndex == master.Attrs().Index {
+					Expect(vlan.Name).To(Equal(MASTER_NAME + ".300"))
+					Expect(vlan.VlanId).To(Equal(300))
+					vlans++
+				}
+			}
+			Expect(vlans).To(Equal(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("verifies the requested MAC address when asked to", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"verifyMac": true
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        fmt.Sprintf("MAC=%s", macAddress),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[0].Mac).To(Equal(macAddress))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("refuses to ADD an interface whose name is already taken", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).To(BeAssignableToTypeOf(&ConflictError{}))
+			Expect(AsCNIError(err).(*types.Error).Code).To(Equal(ErrInterfaceExists))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure the existing link was left alone and nothing else was created
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(links).To(HaveLen(2))
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("dummy"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("sets the netdev group of the macvtap", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"ifGroup": 42
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(linkGroup(link)).To(Equal(uint32(42)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("inherits the GSO limits of the master", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			master, err := netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			maxSize, maxSegs := uint32(32768), uint32(128)
+			Expect(linkSetGSO(master, &maxSize, &maxSegs)).To(Succeed())
+
+			_, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			maxSize, maxSegs, err := linkGSO(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(maxSize).To(Equal(uint32(32768)))
+			Expect(maxSegs).To(Equal(uint32(128)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("overrides the GSO limits inherited from the master", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"gsoMaxSize": 16384,
+    		"gsoMaxSegs": 64
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			maxSize, maxSegs, err := linkGSO(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(maxSize).To(Equal(uint32(16384)))
+			Expect(maxSegs).To(Equal(uint32(64)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("counts every macvtap of an ADD against the rate limit", func() {
+		stateDir, err := ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(stateDir)
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"stateDir": "%s",
+    		"interfaces": 3,
+    		"addRateLimit": {"perSecond": 1, "burst": 2}
+		}`, MASTER_NAME, stateDir)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      "macvt0",
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).To(HaveOccurred())
+			Expect(AsCNIError(err).(*types.Error).Code).To(Equal(ErrTryAgainLater))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(links).To(HaveLen(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("releases the lock of the master while waiting for readiness", func() {
+		const IFNAME = "macvt0"
+
+		origLinkLockDir := linkLockDir
+		defer func() { linkLockDir = origLinkLockDir }()
+		var err error
+		linkLockDir, err = ioutil.TempDir("", "macvtap-link-locks")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(linkLockDir)
+
+		// the master is down, so the macvtap never gets ready
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"waitReady": {"timeout": "2s"}
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		added := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(added)
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+				Expect(err).To(MatchError(ContainSubstring("not ready")))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}()
+
+		Eventually(func() error {
+			return targetNs.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(IFNAME)
+				return err
+			})
+		}).Should(Succeed())
+
+		locked := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+
+			unlock, err := lockLink(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			close(locked)
+			unlock()
+		}()
+		Eventually(locked, time.Second).Should(BeClosed())
+		Expect(added).NotTo(BeClosed())
+		Eventually(added, 3*time.Second).Should(BeClosed())
+	})
+	It("removes the links of a killed ADD for the same attachment", func() {
+		const IFNAME = "macvt0"
+
+		stateDir, err := ioutil.TempDir("", "macvtap-state")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(stateDir)
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"stateDir": "%s"
+		}`, MASTER_NAME, stateDir)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		// the killed ADD renamed its link already, and left its marker behind
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IFNAME}})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		path := inProgressPath(stateDir, "mynet", "dummy", IFNAME)
+		Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(Succeed())
+		marker := fmt.Sprintf(`{"netns": %q, "links": [%q]}`, targetNs.Path(), IFNAME)
+		Expect(ioutil.WriteFile(path, []byte(marker), 0600)).To(Succeed())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).NotTo(BeAnExistingFile())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("macvtap"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("fails to configure a macvtap device with invalid env args", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s",
+    		"failOnUnknownArgs": true
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "WHY=petr_made_me_do_it",
+		}
+
+		// expect the macvtap creation to have failed, because of the invalid argument
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link does not exist in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("configures and deconfigures an already existent macvtap link via ADD/DEL", func() {
+		macvtapIfaceName := "mymacvtap0"
+
+		// create the initial macvtap
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				CNIVersion: "0.3.1",
+				Name:       "testConfig",
+				Type:       "macvtap",
+			},
+			Master: MASTER_NAME,
+			Mode:   "bridge",
+		}
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := CreateMacvtap(conf, macvtapIfaceName, originalNS)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		cniConf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+			"deviceID": "%s"
+		}`, macvtapIfaceName)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      macvtapIfaceName,
+			StdinData:   []byte(cniConf),
+		}
+
+		// Make sure macvtap link exists in the target namespace
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link exists in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(macvtapIfaceName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(macvtapIfaceName))
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNs.Path(),
+				IfName:      macvtapIfaceName,
+				StdinData:   []byte(cniConf),
+			}
+
+			err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error {
+				return CmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure macvtap link has been deleted
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(macvtapIfaceName)
+			Expect(err).To(HaveOccurred())
+			Expect(link).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("assures the macvtap interface cannot be created with an MTU larger than the lower device", func() {
+		const IFNAME = "macvt0"
+
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+			"master": "%s",
+			"mtu": 9000
+		}`, MASTER_NAME)
+
+		targetNs, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			Expect(err).To(HaveOccurred())
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
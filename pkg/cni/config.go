@@ -0,0 +1,336 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cni implements the macvtap CNI plugin: configuration parsing and
+// validation, macvtap link operations, and the CNI command handlers.
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// IPv4InterfaceArpProxySysctlTemplate is the sysctl controlling proxy ARP
+	// on an interface.
+	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
+	// IPv4InterfaceArpNotifySysctlTemplate is the sysctl controlling
+	// whether an interface announces address and device changes via ARP.
+	IPv4InterfaceArpNotifySysctlTemplate = "net.ipv4.conf.%s.arp_notify"
+	// IPv4InterfaceDropGratuitousArpSysctlTemplate is the sysctl controlling
+	// whether an interface drops gratuitous ARP frames.
+	IPv4InterfaceDropGratuitousArpSysctlTemplate = "net.ipv4.conf.%s.drop_gratuitous_arp"
+	// IPv4InterfaceArpIgnoreSysctlTemplate is the sysctl controlling which
+	// ARP requests an interface replies to.
+	IPv4InterfaceArpIgnoreSysctlTemplate = "net.ipv4.conf.%s.arp_ignore"
+	// IPv6InterfaceDisableSysctlTemplate is the sysctl disabling IPv6 on an
+	// interface.
+	IPv6InterfaceDisableSysctlTemplate = "net.ipv6.conf.%s.disable_ipv6"
+)
+
+// defaultStateDir holds the state shared between plugin invocations when
+// "stateDir" is not configured.
+const defaultStateDir = "/run/macvtap-cni"
+
+// maxInterfaces bounds "interfaces", so that a typo cannot create a flood of
+// macvtaps on the master.
+const maxInterfaces = 16
+
+// defaultAllowedDeviceTypes lists the link types that may be imported via
+// the "deviceID" attribute when "allowedDeviceTypes" is not configured.
+var defaultAllowedDeviceTypes = []string{"macvtap"}
+
+// NetConf is the network configuration of the macvtap plugin.
+type NetConf struct {
+	types.NetConf
+	Master                 string     `json:"master"`
+	MasterIndex            int        `json:"masterIndex,omitempty"`
+	MasterMAC              string     `json:"masterMAC,omitempty"`
+	Mode                   string     `json:"mode"`
+	MTU                    int        `json:"mtu,omitempty"`
+	DeviceID               string     `json:"deviceID,omitempty"`
+	AllowedDeviceTypes     []string   `json:"allowedDeviceTypes,omitempty"`
+	AllowedPorts           []PortRule `json:"allowedPorts,omitempty"`
+	BlockedPorts           []PortRule `json:"blockedPorts,omitempty"`
+	WarningsDir            string     `json:"warningsDir,omitempty"`
+	StateDir               string     `json:"stateDir,omitempty"`
+	AddRateLimit           *RateLimit `json:"addRateLimit,omitempty"`
+	ArpNotify              *bool      `json:"arpNotify,omitempty"`
+	DropGratuitousArp      *bool      `json:"dropGratuitousArp,omitempty"`
+	Interfaces             int        `json:"interfaces,omitempty"`
+	AutoLoadModule         bool       `json:"autoLoadModule,omitempty"`
+	AlignMtuWithPrevResult bool       `json:"alignMtuWithPrevResult,omitempty"`
+	WaitReady              *WaitReady `json:"waitReady,omitempty"`
+	Hooks                  *Hooks     `json:"hooks,omitempty"`
+	IfGroup                *uint32    `json:"ifGroup,omitempty"`
+	HandoffDir             string     `json:"handoffDir,omitempty"`
+	Force                  bool       `json:"force,omitempty"`
+	Vrf                    string     `json:"vrf,omitempty"`
+	VrfTable               uint32     `json:"vrfTable,omitempty"`
+	MacOUI                 string     `json:"macOUI,omitempty"`
+	Attach                 *bool      `json:"attach,omitempty"`
+	DirectCreate           bool       `json:"directCreate,omitempty"`
+	FailOnUnknownArgs      bool       `json:"failOnUnknownArgs,omitempty"`
+	AllowMacOverride       *bool      `json:"allowMacOverride,omitempty"`
+	GSOMaxSize             *uint32    `json:"gsoMaxSize,omitempty"`
+	GSOMaxSegs             *uint32    `json:"gsoMaxSegs,omitempty"`
+	TapDeviceProvisioning  string     `json:"tapDeviceProvisioning,omitempty"`
+	TapDeviceTimeout       string     `json:"tapDeviceTimeout,omitempty"`
+	PreferAllocatedDevice  bool       `json:"preferAllocatedDevice,omitempty"`
+	Vlan                   int        `json:"vlan,omitempty"`
+	VerifyMac              bool       `json:"verifyMac,omitempty"`
+	EnableIPv4             *bool      `json:"enableIPv4,omitempty"`
+	EnableIPv6             *bool      `json:"enableIPv6,omitempty"`
+	FailuresDir            string     `json:"failuresDir,omitempty"`
+	ResultFile             string     `json:"resultFile,omitempty"`
+	Description            string     `json:"description,omitempty"`
+	RuntimeConfig          struct {
+		Mode string `json:"mode,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+	// Args holds per-attachment values passed in the configuration, following
+	// the "args" convention of CNI.
+	Args struct {
+		CNI struct {
+			MAC  string `json:"mac,omitempty"`
+			MTU  int    `json:"mtu,omitempty"`
+			Mode string `json:"mode,omitempty"`
+		} `json:"cni,omitempty"`
+	} `json:"args,omitempty"`
+}
+
+// EnvArgs holds the CNI_ARGS understood by the plugin.
+type EnvArgs struct {
+	types.CommonArgs
+	MAC  types.UnmarshallableString `json:"mac,omitempty"`
+	MODE types.UnmarshallableString `json:"mode,omitempty"`
+}
+
+// LoadConf parses the network configuration and returns it together with
+// the requested CNI version.
+func LoadConf(bytes []byte) (*NetConf, string, error) {
+	if err := validateAgainstSchema(bytes); err != nil {
+		return nil, "", err
+	}
+
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if err := parsePrevResult(&n.NetConf); err != nil {
+		return nil, "", err
+	}
+
+	if n.Master != "" && n.DeviceID != "" {
+		// the device plugin injects deviceID into a configuration which may
+		// also name a master
+		if !n.PreferAllocatedDevice {
+			return nil, "", fmt.Errorf(`device %q allocated by the device plugin conflicts with master %q: drop "master" from the configuration, or set "preferAllocatedDevice"`, n.DeviceID, n.Master)
+		}
+		warnf("ignoring master %q in favor of the allocated device %q", n.Master, n.DeviceID)
+		n.Master = ""
+	} else if n.Master == "" && n.DeviceID == "" {
+		return nil, "", fmt.Errorf(`"Either (exclusive) "deviceID" or "master" attributes are required."`)
+	}
+
+	if err := validatePortRules(n.AllowedPorts); err != nil {
+		return nil, "", err
+	}
+	if err := validatePortRules(n.BlockedPorts); err != nil {
+		return nil, "", err
+	}
+	if err := validatePortRulesConsumer(n); err != nil {
+		return nil, "", err
+	}
+	if err := validateRateLimit(n.AddRateLimit); err != nil {
+		return nil, "", err
+	}
+	if n.WaitReady != nil {
+		if _, err := parseWaitReadyTimeout(n.WaitReady); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := validateHooks(n.Hooks); err != nil {
+		return nil, "", err
+	}
+	if n.Interfaces < 0 {
+		return nil, "", fmt.Errorf("invalid interfaces count %d, must not be negative", n.Interfaces)
+	}
+	if n.Interfaces > maxInterfaces {
+		return nil, "", fmt.Errorf("invalid interfaces count %d, must be at most %d", n.Interfaces, maxInterfaces)
+	}
+	if n.Interfaces > 1 && n.DeviceID != "" {
+		return nil, "", fmt.Errorf(`"interfaces" cannot be used with the "deviceID" attribute`)
+	}
+	if err := validateTapDeviceProvisioning(n); err != nil {
+		return nil, "", err
+	}
+	if n.MacOUI != "" {
+		if _, err := parseMacOUI(n.MacOUI); err != nil {
+			return nil, "", err
+		}
+	}
+	if n.Vlan != 0 && n.Master == "" {
+		return nil, "", fmt.Errorf(`"vlan" requires the "master" attribute`)
+	}
+	if n.EnableIPv4 != nil && !*n.EnableIPv4 && n.EnableIPv6 != nil && !*n.EnableIPv6 {
+		return nil, "", fmt.Errorf(`"enableIPv4" and "enableIPv6" cannot both be false`)
+	}
+	if n.ResultFile != "" {
+		if err := validateResultFile(n.ResultFile); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := validateDescription(n.Description); err != nil {
+		return nil, "", err
+	}
+	if n.VrfTable != 0 && n.Vrf == "" {
+		return nil, "", fmt.Errorf(`"vrfTable" requires the "vrf" attribute`)
+	}
+	// the network name scopes the plugin state on disk
+	if strings.Contains(n.Name, "/") || n.Name == "." || n.Name == ".." {
+		return nil, "", fmt.Errorf("invalid network name %q", n.Name)
+	}
+
+	if n.StateDir == "" {
+		n.StateDir = defaultStateDir
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+// ValidateConf checks the configuration against the state of the host.
+func ValidateConf(netConf NetConf) error {
+	if netConf.Master != "" {
+		masterMTU, err := getMTUByName(netConf.Master)
+		// check existing and MTU of master interface
+		if err != nil {
+			return err
+		}
+		if netConf.MTU < 0 || netConf.MTU > masterMTU {
+			return fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", netConf.MTU, masterMTU)
+		}
+	}
+	if netConf.DeviceID != "" && netConf.MTU != 0 {
+		// the imported device cannot exceed the MTU of its lower device
+		// either, and LinkSetMTU would only fail once it is in the netns
+		if netConf.MTU < 0 {
+			return fmt.Errorf("invalid MTU %d, must not be negative", netConf.MTU)
+		}
+		lowerMTU, err := getLowerDeviceMTU(netConf.DeviceID)
+		if err != nil {
+			return err
+		}
+		if lowerMTU > 0 && netConf.MTU > lowerMTU {
+			return fmt.Errorf("invalid MTU %d, must be [0, lower device MTU(%d)] of %q", netConf.MTU, lowerMTU, netConf.DeviceID)
+		}
+	}
+	return nil
+}
+
+// GetEnvArgs parses a CNI_ARGS string. Unknown keys are an error, unless
+// the string sets IgnoreUnknown=1.
+func GetEnvArgs(envArgsString string) (EnvArgs, error) {
+	return parseEnvArgs(envArgsString, false)
+}
+
+// parseEnvArgs parses a CNI_ARGS string, ignoring unknown keys when
+// ignoreUnknown is set or the string sets IgnoreUnknown=1.
+func parseEnvArgs(envArgsString string, ignoreUnknown bool) (EnvArgs, error) {
+	if envArgsString != "" {
+		e := EnvArgs{}
+		e.IgnoreUnknown = types.UnmarshallableBool(ignoreUnknown)
+		err := types.LoadArgs(envArgsString, &e)
+		if err != nil {
+			return EnvArgs{}, err
+		}
+		return e, nil
+	}
+	return EnvArgs{}, nil
+}
+
+// applyArgsCNI applies the MAC address and MTU requested in args.cni. A MAC
+// address passed in CNI_ARGS takes precedence.
+func applyArgsCNI(conf *NetConf, envArgs *EnvArgs) {
+	if envArgs.MAC == "" && conf.Args.CNI.MAC != "" {
+		envArgs.MAC = types.UnmarshallableString(conf.Args.CNI.MAC)
+	}
+	if conf.Args.CNI.MTU > 0 {
+		conf.MTU = conf.Args.CNI.MTU
+	}
+}
+
+// validateMacOverride rejects a MAC address requested through CNI_ARGS when
+// the network does not allow picking one.
+func validateMacOverride(conf *NetConf, envArgs EnvArgs) error {
+	if envArgs.MAC != "" && conf.AllowMacOverride != nil && !*conf.AllowMacOverride {
+		return fmt.Errorf("network %q does not allow requesting MAC address %s", conf.Name, envArgs.MAC)
+	}
+	return nil
+}
+
+// ApplyModeOverride replaces the configured mode with the one requested for
+// this attachment, if any. runtimeConfig takes precedence over CNI_ARGS,
+// which takes precedence over args.cni.
+func ApplyModeOverride(conf *NetConf, envArgs EnvArgs) error {
+	mode := conf.Mode
+	if conf.Args.CNI.Mode != "" {
+		mode = conf.Args.CNI.Mode
+	}
+	if envArgs.MODE != "" {
+		mode = string(envArgs.MODE)
+	}
+	if conf.RuntimeConfig.Mode != "" {
+		mode = conf.RuntimeConfig.Mode
+	}
+	if _, err := ModeFromString(mode); err != nil {
+		return err
+	}
+	conf.Mode = mode
+	return nil
+}
+
+// ModeFromString converts a mode name to its netlink representation. An
+// empty name selects bridge mode.
+func ModeFromString(s string) (netlink.MacvlanMode, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	default:
+		return 0, fmt.Errorf("unknown macvtap mode: %q", s)
+	}
+}
+
+// ModeToString converts a netlink macvlan mode to its name.
+func ModeToString(mode netlink.MacvlanMode) (string, error) {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge", nil
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private", nil
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa", nil
+	default:
+		return "", fmt.Errorf("unknown macvtap mode: %q", mode)
+	}
+}
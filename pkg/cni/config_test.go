@@ -0,0 +1,128 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni_test
+
+import (
+	"encoding/json"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/maiqueb/macvtap-cni/pkg/cni"
+)
+
+var _ = Describe("public configuration API", func() {
+	It("loads a configuration and reports its CNI version", func() {
+		netConf, cniVersion, err := cni.LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"mode": "vepa",
+			"mtu": 1400
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cniVersion).To(Equal("0.3.1"))
+		Expect(netConf.Master).To(Equal("eth0"))
+		Expect(netConf.Mode).To(Equal("vepa"))
+		Expect(netConf.MTU).To(Equal(1400))
+	})
+	It("parses CNI_ARGS", func() {
+		envArgs, err := cni.GetEnvArgs("IgnoreUnknown=1;MAC=0a:59:00:dc:6a:e0;MODE=private")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(envArgs.MAC)).To(Equal("0a:59:00:dc:6a:e0"))
+		Expect(string(envArgs.MODE)).To(Equal("private"))
+	})
+	It("round-trips every supported mode", func() {
+		for _, name := range []string{"bridge", "private", "vepa"} {
+			mode, err := cni.ModeFromString(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cni.ModeToString(mode)).To(Equal(name))
+		}
+		mode, err := cni.ModeFromString("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mode).To(Equal(netlink.MACVLAN_MODE_BRIDGE))
+	})
+	It("advertises its capabilities", func() {
+		capabilities := cni.GetCapabilities()
+		Expect(capabilities.ConfigFields).To(ContainElement("master"))
+		Expect(capabilities.ConfigFields).To(ContainElement("deviceID"))
+		Expect(capabilities.ConfigFields).NotTo(ContainElement("cniVersion"))
+		Expect(capabilities.CNIArgs).To(ConsistOf("MAC", "MODE"))
+		Expect(capabilities.Modes).To(Equal(cni.SupportedModes))
+		Expect(capabilities.CNIVersions).To(ContainElement("0.3.1"))
+	})
+	It("publishes a schema covering every configuration field", func() {
+		var schema struct {
+			Properties map[string]interface{} `json:"properties"`
+		}
+		Expect(json.Unmarshal([]byte(cni.Schema), &schema)).To(Succeed())
+		for _, field := range cni.GetCapabilities().ConfigFields {
+			Expect(schema.Properties).To(HaveKey(field))
+		}
+	})
+	It("reports the path of a field violating the schema", func() {
+		_, _, err := cni.LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"blockedPorts": [{"protocol": "tcp", "port": 22}, {"protocol": "tcp", "port": "ssh"}]
+		}`))
+		Expect(err).To(MatchError(`invalid configuration: "blockedPorts[1].port" must be of type integer`))
+
+		_, _, err = cni.LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"mode": "passthrough"
+		}`))
+		Expect(err).To(MatchError(ContainSubstring(`"mode" must be one of`)))
+	})
+	It("rejects a netdev group out of range", func() {
+		for _, group := range []string{"-1", "4294967296"} {
+			_, _, err := cni.LoadConf([]byte(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "macvtap",
+				"master": "eth0",
+				"ifGroup": ` + group + `
+			}`))
+			Expect(err).To(MatchError(ContainSubstring(`"ifGroup" must be at`)))
+		}
+		netConf, _, err := cni.LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"ifGroup": 4294967295
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*netConf.IfGroup).To(Equal(uint32(4294967295)))
+	})
+	It("accepts fields it does not know about", func() {
+		_, _, err := cni.LoadConf([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "macvtap",
+			"master": "eth0",
+			"prevResult": {"interfaces": []}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
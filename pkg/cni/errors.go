@@ -0,0 +1,94 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// The CNI error codes reported for each class of failure, besides
+// ErrInterfaceExists for a ConflictError. ErrInvalidConfig is the well known
+// "invalid network config" code of the CNI specification.
+const (
+	ErrInvalidConfig uint = 7
+	ErrNamespace     uint = 102
+	ErrKernel        uint = 103
+)
+
+// ConfigError reports an invalid network configuration or CNI argument, or
+// one that does not match the host.
+type ConfigError struct{ Err error }
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+
+// KernelError reports a netlink, sysctl or other kernel operation that
+// failed, including the file operations on the plugin state.
+type KernelError struct{ Err error }
+
+func (e *KernelError) Error() string { return e.Err.Error() }
+
+// NamespaceError reports a container netns that cannot be opened or entered.
+type NamespaceError struct{ Err error }
+
+func (e *NamespaceError) Error() string { return e.Err.Error() }
+
+// ConflictError reports that an interface name is already taken in the
+// container netns.
+type ConflictError struct{ Err error }
+
+func (e *ConflictError) Error() string { return e.Err.Error() }
+
+// kernelError reports err as a KernelError, unless it already carries a
+// class or a CNI error code.
+func kernelError(err error) error {
+	switch err.(type) {
+	case *ConfigError, *KernelError, *NamespaceError, *ConflictError, *types.Error:
+		return err
+	default:
+		return &KernelError{err}
+	}
+}
+
+// netnsError reports a path that is not a netns, or none at all, passed to
+// ns.WithNetNSPath as a NamespaceError.
+func netnsError(err error) error {
+	switch err.(type) {
+	case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		return &NamespaceError{err}
+	default:
+		return err
+	}
+}
+
+// AsCNIError maps the typed errors of the plugin to a CNI error result
+// carrying their code, so that the runtime and automation reading it can
+// branch on the class of failure. Other errors are returned unchanged.
+func AsCNIError(err error) error {
+	var code uint
+	switch err.(type) {
+	case *ConfigError:
+		code = ErrInvalidConfig
+	case *KernelError:
+		code = ErrKernel
+	case *NamespaceError:
+		code = ErrNamespace
+	case *ConflictError:
+		code = ErrInterfaceExists
+	default:
+		return err
+	}
+	return &types.Error{Code: code, Msg: err.Error()}
+}
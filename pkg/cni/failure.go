@@ -0,0 +1,109 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Failure describes the last failed ADD of an attachment: the step that
+// failed, the error, and what the rollback did about it.
+type Failure struct {
+	Time     string   `json:"time"`
+	Step     string   `json:"step"`
+	Error    string   `json:"error"`
+	Rollback []string `json:"rollback,omitempty"`
+}
+
+// failure tracks the progress of the current ADD. The plugin handles a
+// single command per process, so a package level record is enough.
+var failure Failure
+
+func resetFailure() {
+	failure = Failure{}
+}
+
+// setStep records the step the current ADD is at.
+func setStep(step string) {
+	failure.Step = step
+}
+
+// recordRollback records an action taken to undo a failed ADD.
+func recordRollback(format string, args ...interface{}) {
+	failure.Rollback = append(failure.Rollback, fmt.Sprintf(format, args...))
+}
+
+func failureFilePath(dir, containerID, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+// writeFailure stores the failure of the current ADD in dir, so users find
+// the failed step without scraping the runtime logs.
+func writeFailure(dir, containerID, ifName string, err error) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create failures dir %q: %v", dir, err)
+	}
+	failure.Time = time.Now().UTC().Format(time.RFC3339)
+	failure.Error = err.Error()
+	data, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	path := failureFilePath(dir, containerID, ifName)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write failure file %q: %v", path, err)
+	}
+	return nil
+}
+
+// ReadFailure returns the last failed ADD recorded in dir for an attachment,
+// or nil if there is none or no failures dir is configured. The plugin
+// records the failures of a network in the <failuresDir>/<network> dir.
+func ReadFailure(dir, containerID, ifName string) (*Failure, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(failureFilePath(dir, containerID, ifName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	f := &Failure{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("failed to parse failure file: %v", err)
+	}
+	return f, nil
+}
+
+// ClearFailure removes the last failed ADD recorded in dir for an attachment.
+func ClearFailure(dir, containerID, ifName string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.Remove(failureFilePath(dir, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build faultinject
+// +build faultinject
+
+package cni
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// faults maps a step to the error injected there. Tests set it directly;
+// the plugin binary reads it from MACVTAP_CNI_FAULTS, a comma separated list
+// of step=ERRNO pairs, e.g. "rename=ENODEV,sysctl=EACCES".
+var faults = map[string]error{}
+
+var faultErrnos = map[string]syscall.Errno{
+	"EACCES": syscall.EACCES,
+	"EEXIST": syscall.EEXIST,
+	"ENODEV": syscall.ENODEV,
+	"EPERM":  syscall.EPERM,
+	"EBUSY":  syscall.EBUSY,
+}
+
+func init() {
+	for _, fault := range strings.Split(os.Getenv("MACVTAP_CNI_FAULTS"), ",") {
+		parts := strings.SplitN(fault, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if errno, ok := faultErrnos[parts[1]]; ok {
+			faults[parts[0]] = errno
+		}
+	}
+}
+
+// injectFault returns the error configured for step, if any.
+func injectFault(step string) error {
+	return faults[step]
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build faultinject
+// +build faultinject
+
+package cni
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("fault injection", func() {
+	var originalNS, targetNs ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNs, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			return netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: MASTER_NAME,
+				},
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		faults = map[string]error{}
+		Expect(targetNs.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNs)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+	})
+
+	// expectNoMacvtap checks that a failed ADD left no link behind.
+	expectNoMacvtap := func() {
+		err := targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, link := range links {
+				Expect(link.Type()).NotTo(Equal("macvtap"), "leaked link %q", link.Attrs().Name)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	addArgs := func(extraConf, cniArgs string) *skel.CmdArgs {
+		conf := fmt.Sprintf(`{
+    		"cniVersion": "0.3.1",
+    		"name": "mynet",
+    		"type": "macvtap",
+    		"master": "%s"%s
+		}`, MASTER_NAME, extraConf)
+		return &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      "macvt0",
+			StdinData:   []byte(conf),
+			Args:        cniArgs,
+		}
+	}
+
+	cmdAdd := func(args *skel.CmdArgs) error {
+		return originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return CmdAdd(args) })
+			return err
+		})
+	}
+
+	It("reports a failure to create the link", func() {
+		faults[faultLinkAdd] = syscall.EEXIST
+		Expect(cmdAdd(addArgs("", ""))).To(MatchError(ContainSubstring("file exists")))
+		expectNoMacvtap()
+	})
+	It("removes the link when an ARP sysctl cannot be set", func() {
+		faults[faultSysctl] = syscall.EACCES
+		Expect(cmdAdd(addArgs(`, "arpNotify": true`, ""))).To(MatchError(ContainSubstring("permission denied")))
+		expectNoMacvtap()
+	})
+	It("removes the link when it cannot be renamed", func() {
+		faults[faultRename] = syscall.ENODEV
+		Expect(cmdAdd(addArgs("", ""))).To(MatchError(ContainSubstring("no such device")))
+		expectNoMacvtap()
+	})
+	It("removes the link when its MAC address cannot be set", func() {
+		faults[faultSetMac] = syscall.ENODEV
+		Expect(cmdAdd(addArgs("", "MAC="+macAddress))).To(MatchError(ContainSubstring("no such device")))
+		expectNoMacvtap()
+	})
+})
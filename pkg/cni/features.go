@@ -0,0 +1,69 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// featureGatesFile enables behaviors on a single node, as a JSON object
+// mapping gate names to booleans, e.g. {"DirectCreate": true}. Admins can
+// roll a behavior out to a few canary nodes before enabling it in the
+// network configurations of the whole fleet.
+var featureGatesFile = "/etc/macvtap-cni/feature-gates.json"
+
+// featureDirectCreate turns on "directCreate" for every network.
+const featureDirectCreate = "DirectCreate"
+
+var knownFeatureGates = map[string]bool{
+	featureDirectCreate: true,
+}
+
+// loadFeatureGates reads the feature gates of the node. A missing file
+// enables none.
+func loadFeatureGates() (map[string]bool, error) {
+	data, err := ioutil.ReadFile(featureGatesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read feature gates %q: %v", featureGatesFile, err)
+	}
+	gates := map[string]bool{}
+	if err := json.Unmarshal(data, &gates); err != nil {
+		return nil, fmt.Errorf("failed to parse feature gates %q: %v", featureGatesFile, err)
+	}
+	for gate := range gates {
+		if !knownFeatureGates[gate] {
+			warnf("ignoring unknown feature gate %q in %s", gate, featureGatesFile)
+		}
+	}
+	return gates, nil
+}
+
+// applyFeatureGates turns on the behaviors the node enables on top of conf.
+func applyFeatureGates(conf *NetConf) error {
+	gates, err := loadFeatureGates()
+	if err != nil {
+		return err
+	}
+	if gates[featureDirectCreate] {
+		conf.DirectCreate = true
+	}
+	return nil
+}
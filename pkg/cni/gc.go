@@ -0,0 +1,145 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gcAttachment is an entry of the list of attachments GC must keep.
+type gcAttachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// CmdGC implements the CNI GC command: it removes the per-network files of
+// the attachments missing from "cni.dev/valid-attachments", and the markers
+// of their interrupted ADDs.
+func CmdGC(stdinData []byte) error {
+	n, _, err := LoadConf(stdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	var gcConf struct {
+		ValidAttachments []gcAttachment `json:"cni.dev/valid-attachments"`
+	}
+	if err := json.Unmarshal(stdinData, &gcConf); err != nil {
+		return fmt.Errorf("failed to load valid attachments: %v", err)
+	}
+
+	valid := map[string]bool{}
+	for _, attachment := range gcConf.ValidAttachments {
+		ifNames, err := interfaceNames(attachment.IfName, n.Interfaces)
+		if err != nil {
+			ifNames = []string{attachment.IfName}
+		}
+		for _, ifName := range ifNames {
+			valid[fmt.Sprintf("%s-%s.json", attachment.ContainerID, ifName)] = true
+		}
+	}
+
+	if err := cleanupInterruptedAdds(inProgressDir(n.StateDir, n.Name), valid); err != nil {
+		return err
+	}
+	if n.ResultFile != "" {
+		// result files are where the user put them, they can only be told
+		// apart from the ones of other networks when the path says so
+		if resultFileScoped(n.ResultFile, n.Name) {
+			if err := removeStaleResultFiles(n.ResultFile, valid); err != nil {
+				return err
+			}
+		} else {
+			warnf("not collecting the result files of network %q: no directory of resultFile %q is named after it", n.Name, n.ResultFile)
+		}
+	}
+	for _, dir := range []string{n.WarningsDir, n.HandoffDir, n.FailuresDir} {
+		if dir == "" {
+			continue
+		}
+		if err := removeStaleFiles(networkDir(dir, n.Name), valid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkDir returns the subdirectory of dir holding the attachment files of
+// the network called name, so that networks sharing dir, e.g. a node wide
+// warnings dir, do not collect each other's files. It is empty when dir is.
+func networkDir(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// resultFileScoped reports whether the resultFile template keeps the results
+// of the network called name apart from the ones of other networks, in a
+// directory named after it.
+func resultFileScoped(template, name string) bool {
+	for _, element := range strings.Split(filepath.Dir(template), string(filepath.Separator)) {
+		if element == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStaleFiles removes the attachment files in dir whose name is not in
+// valid.
+func removeStaleFiles(dir string, valid map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") || valid[file.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupInterruptedAdds finishes the cleanup of the killed ADDs whose marker
+// in dir is not in valid.
+func cleanupInterruptedAdds(dir string, valid map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") || valid[file.Name()] {
+			continue
+		}
+		if err := cleanupInterruptedAdd(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// The kernel copies the GSO limits of the master to a macvtap when creating
+// it. The vendored netlink library neither reports nor sets them, so they
+// are handled with hand built requests, like the netdev group.
+
+// linkGSO returns the gso_max_size and gso_max_segs of link.
+func linkGSO(link netlink.Link) (uint32, uint32, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return 0, 0, err
+	}
+	var maxSize, maxSegs uint32
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[unix.SizeofIfInfomsg:])
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFLA_GSO_MAX_SIZE:
+				maxSize = nl.NativeEndian().Uint32(attr.Value[:4])
+			case unix.IFLA_GSO_MAX_SEGS:
+				maxSegs = nl.NativeEndian().Uint32(attr.Value[:4])
+			}
+		}
+	}
+	return maxSize, maxSegs, nil
+}
+
+// linkSetGSO overrides the GSO limits of link that are not nil.
+func linkSetGSO(link netlink.Link, maxSize, maxSegs *uint32) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	if maxSize != nil {
+		req.AddData(nl.NewRtAttr(unix.IFLA_GSO_MAX_SIZE, nl.Uint32Attr(*maxSize)))
+	}
+	if maxSegs != nil {
+		req.AddData(nl.NewRtAttr(unix.IFLA_GSO_MAX_SEGS, nl.Uint32Attr(*maxSegs)))
+	}
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func setInterfaceGSO(ifName string, conf *NetConf, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := linkSetGSO(link, conf.GSOMaxSize, conf.GSOMaxSegs); err != nil {
+			return fmt.Errorf("failed to set the GSO limits of %q: %v", ifName, err)
+		}
+		// older kernels accept the attributes but ignore them
+		maxSize, maxSegs, err := linkGSO(link)
+		if err != nil {
+			return fmt.Errorf("failed to read the GSO limits of %q: %v", ifName, err)
+		}
+		if (conf.GSOMaxSize != nil && maxSize != *conf.GSOMaxSize) || (conf.GSOMaxSegs != nil && maxSegs != *conf.GSOMaxSegs) {
+			return fmt.Errorf("the kernel ignored the GSO limits of %q, which are gso_max_size %d and gso_max_segs %d", ifName, maxSize, maxSegs)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// Handoff describes a macvtap to the userspace consumer of its tap device
+// (e.g. a DPDK application using virtio-user), so it does not have to
+// inspect the container netns itself.
+type Handoff struct {
+	ContainerID string `json:"containerID"`
+	// Netns is the netns reference passed by the runtime. A "pid:"
+	// reference comes with NetnsInode, to tell whether the pid was reused
+	// since; an "fd:" one, meaningless to other processes, is left out and
+	// only NetnsInode identifies the netns.
+	Netns      string `json:"netns,omitempty"`
+	NetnsInode uint64 `json:"netnsInode,omitempty"`
+	IfName     string `json:"ifName"`
+	IfIndex    int    `json:"ifIndex"`
+	MAC        string `json:"mac"`
+	MTU        int    `json:"mtu"`
+	TapPath    string `json:"tapPath"`
+	NumQueues  int    `json:"numQueues"`
+	GSOMaxSize uint32 `json:"gsoMaxSize"`
+	GSOMaxSegs uint32 `json:"gsoMaxSegs"`
+	// VnetHdrSize is the size of the virtio-net header the tap device
+	// prepends to packets, which the consumer must open it with.
+	VnetHdrSize int `json:"vnetHdrSize"`
+	// Description is the "description" of the network, if any.
+	Description string `json:"description,omitempty"`
+	// VhostNet tells whether the consumer can use the in-kernel vhost-net
+	// backend, or must fall back to a userspace one.
+	VhostNet bool `json:"vhostNet"`
+}
+
+var vhostNetPath = "/dev/vhost-net"
+
+// vhostNetAvailable reports whether the vhost-net device is accessible.
+func vhostNetAvailable() bool {
+	return unix.Access(vhostNetPath, unix.R_OK|unix.W_OK) == nil
+}
+
+// defaultVnetHdrSize is the size of struct virtio_net_hdr, which the kernel
+// uses for a tap device until its consumer sets another with TUNSETVNETHDRSZ.
+const defaultVnetHdrSize = 10
+
+// tapVnetHdrSize reads the vnet header size of the tap device at path, or
+// returns the kernel default when the device cannot be opened yet.
+func tapVnetHdrSize(path string) int {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return defaultVnetHdrSize
+	}
+	defer f.Close()
+	size, err := unix.IoctlGetInt(int(f.Fd()), unix.TUNGETVNETHDRSZ)
+	if err != nil {
+		return defaultVnetHdrSize
+	}
+	return size
+}
+
+// devDir is where devtmpfs exposes the tap devices.
+var devDir = "/dev"
+
+// TapDevicePath returns the path of the character device backing the
+// macvtap with index ifIndex.
+func TapDevicePath(ifIndex int) string {
+	return filepath.Join(devDir, fmt.Sprintf("tap%d", ifIndex))
+}
+
+func handoffFilePath(dir, containerID, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+func buildHandoff(containerID, netnsRef string, netns ns.NetNS, ifName string) (*Handoff, error) {
+	netnsRef, inode, err := persistentNetns(netnsRef, netns)
+	if err != nil {
+		return nil, err
+	}
+	var handoff *Handoff
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		gsoMaxSize, gsoMaxSegs, err := linkGSO(link)
+		if err != nil {
+			return fmt.Errorf("failed to get the GSO limits of %q: %v", ifName, err)
+		}
+		alias, _ := parseLinkAlias(link.Attrs().Alias)
+		handoff = &Handoff{
+			ContainerID: containerID,
+			Netns:       netnsRef,
+			NetnsInode:  inode,
+			IfName:      ifName,
+			IfIndex:     link.Attrs().Index,
+			MAC:         link.Attrs().HardwareAddr.String(),
+			MTU:         link.Attrs().MTU,
+			TapPath:     TapDevicePath(link.Attrs().Index),
+			NumQueues:   link.Attrs().NumTxQueues,
+			GSOMaxSize:  gsoMaxSize,
+			GSOMaxSegs:  gsoMaxSegs,
+			VnetHdrSize: tapVnetHdrSize(TapDevicePath(link.Attrs().Index)),
+			VhostNet:    vhostNetAvailable(),
+			Description: alias.Description,
+		}
+		return nil
+	})
+	return handoff, err
+}
+
+// writeHandoff stores the handoff metadata of ifName as
+// <dir>/<containerID>-<ifName>.json.
+func writeHandoff(dir, containerID, netnsRef string, netns ns.NetNS, ifName string) error {
+	handoff, err := buildHandoff(containerID, netnsRef, netns, ifName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create handoff dir %q: %v", dir, err)
+	}
+	data, err := json.Marshal(handoff)
+	if err != nil {
+		return err
+	}
+	path := handoffFilePath(dir, containerID, ifName)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write handoff file %q: %v", path, err)
+	}
+	return nil
+}
+
+func removeHandoff(dir, containerID, ifName string) error {
+	if err := os.Remove(handoffFilePath(dir, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+const hookTimeout = 10 * time.Second
+
+// Hooks lists node-local executables or URLs notified once an ADD or DEL
+// completed.
+type Hooks struct {
+	PostAdd []Hook `json:"postAdd,omitempty"`
+	PostDel []Hook `json:"postDel,omitempty"`
+}
+
+// Hook is either an executable, which receives the event as JSON on stdin,
+// or a URL the event is POSTed to.
+type Hook struct {
+	Exec string `json:"exec,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// HookEvent describes a completed attachment operation.
+type HookEvent struct {
+	Event       string               `json:"event"`
+	ContainerID string               `json:"containerID"`
+	Netns       string               `json:"netns"`
+	IfName      string               `json:"ifName"`
+	Interfaces  []*current.Interface `json:"interfaces,omitempty"`
+}
+
+func validateHooks(hooks *Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	for _, hook := range append(hooks.PostAdd, hooks.PostDel...) {
+		if (hook.Exec == "") == (hook.URL == "") {
+			return fmt.Errorf(`hooks must have exactly one of "exec" or "url"`)
+		}
+	}
+	return nil
+}
+
+// runHooks notifies every hook about event. The operation already
+// succeeded, so failures are reported as warnings.
+func runHooks(hooks []Hook, event HookEvent) {
+	if len(hooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		warnf("failed to encode %s hook event: %v", event.Event, err)
+		return
+	}
+	for _, hook := range hooks {
+		if err := runHook(hook, payload); err != nil {
+			warnf("%s hook failed: %v", event.Event, err)
+		}
+	}
+}
+
+func runHook(hook Hook, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if hook.Exec != "" {
+		cmd := exec.CommandContext(ctx, hook.Exec)
+		cmd.Stdin = bytes.NewReader(payload)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v: %s", hook.Exec, err, out)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", hook.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// inProgress is the marker of the ADD running in this process. It records
+// the links created so far in the container netns, under their current name,
+// and is persisted so that the DEL or GC following a killed ADD can remove
+// them. The ADD holds a lock on the marker file until it ends, telling its
+// marker apart from the one of a killed ADD. The plugin handles a single
+// command per process, so a package level marker is enough.
+type inProgress struct {
+	// Netns and NetnsInode identify the container netns as persistentNetns
+	// records it.
+	Netns      string   `json:"netns,omitempty"`
+	NetnsInode uint64   `json:"netnsInode,omitempty"`
+	Links      []string `json:"links"`
+
+	path string
+	file *os.File
+	// netnsPath is where this process opened the netns.
+	netnsPath string
+}
+
+var (
+	inProgressMu sync.Mutex
+	currentAdd   *inProgress
+)
+
+// inProgressDir holds the markers of the network called name, so that DEL
+// and GC of one network never act on the markers of another.
+func inProgressDir(stateDir, name string) string {
+	return filepath.Join(stateDir, "in-progress", name)
+}
+
+func inProgressPath(stateDir, name, containerID, ifName string) string {
+	return filepath.Join(inProgressDir(stateDir, name), fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+func (m *inProgress) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = m.file.WriteAt(data, 0)
+	return err
+}
+
+// beginAdd persists the marker of an ADD about to create links in netns,
+// which the runtime referenced as netnsRef.
+func beginAdd(stateDir, name, containerID, ifName, netnsRef string, netns ns.NetNS) error {
+	path := inProgressPath(stateDir, name, containerID, ifName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create in-progress dir: %v", err)
+	}
+	netnsRef, inode, err := persistentNetns(netnsRef, netns)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open in-progress marker %q: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to lock in-progress marker %q: %v", path, err)
+	}
+	// a marker left behind by a killed ADD for the same attachment names
+	// links that nothing else would find once it is overwritten
+	if err := removeMarkedLinks(f, path); err != nil {
+		f.Close()
+		return err
+	}
+	marker := &inProgress{Netns: netnsRef, NetnsInode: inode, path: path, file: f, netnsPath: netns.Path()}
+	if err := marker.save(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write in-progress marker %q: %v", path, err)
+	}
+
+	inProgressMu.Lock()
+	defer inProgressMu.Unlock()
+	currentAdd = marker
+	return nil
+}
+
+// endAdd removes the marker once the ADD completed or rolled back.
+func endAdd() {
+	inProgressMu.Lock()
+	defer inProgressMu.Unlock()
+	if currentAdd == nil {
+		return
+	}
+	if err := os.Remove(currentAdd.path); err != nil && !os.IsNotExist(err) {
+		warnf("failed to remove in-progress marker %q: %v", currentAdd.path, err)
+	}
+	// closing the file releases the lock
+	currentAdd.file.Close()
+	currentAdd = nil
+}
+
+// trackLink records that the running ADD created name, or renamed oldName to
+// name when oldName is set.
+func trackLink(oldName, name string) {
+	inProgressMu.Lock()
+	defer inProgressMu.Unlock()
+	if currentAdd == nil {
+		return
+	}
+	links := []string{}
+	for _, link := range currentAdd.Links {
+		if link != oldName {
+			links = append(links, link)
+		}
+	}
+	currentAdd.Links = append(links, name)
+	if err := currentAdd.save(); err != nil {
+		warnf("failed to update in-progress marker %q: %v", currentAdd.path, err)
+	}
+}
+
+func removeLinks(netnsPath string, links []string) error {
+	if len(links) == 0 {
+		return nil
+	}
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		for _, link := range links {
+			if err := ip.DelLinkByName(link); err != nil && err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rollbackOnSignal removes the links tracked by the running ADD and exits
+// when the runtime kills the plugin, e.g. on its CNI timeout. The returned
+// function stops watching for signals.
+func rollbackOnSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			inProgressMu.Lock()
+			marker := currentAdd
+			inProgressMu.Unlock()
+			if marker != nil {
+				if err := removeLinks(marker.netnsPath, marker.Links); err != nil {
+					fmt.Fprintf(os.Stderr, "macvtap-cni: failed to roll back interrupted ADD: %v\n", err)
+					os.Exit(1)
+				}
+				os.Remove(marker.path)
+			}
+			fmt.Fprintf(os.Stderr, "macvtap-cni: ADD interrupted by %v, rolled back\n", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// cleanupInterruptedAdd removes the links left behind by a killed ADD
+// according to its marker at path, and the marker itself. The marker of an
+// ADD still running, which holds its lock, is left alone.
+func cleanupInterruptedAdd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return nil
+		}
+		return fmt.Errorf("failed to lock in-progress marker %q: %v", path, err)
+	}
+	// the ADD may have completed and removed its marker between the open
+	// and the lock
+	if removed, err := fileReplaced(f, path); err != nil || removed {
+		return err
+	}
+	if err := removeMarkedLinks(f, path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeMarkedLinks removes the links recorded in the locked marker f read
+// from path. An empty marker records nothing.
+func removeMarkedLinks(f *os.File, path string) error {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read in-progress marker %q: %v", path, err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	marker := &inProgress{}
+	if err := json.Unmarshal(data, marker); err != nil {
+		return fmt.Errorf("failed to parse in-progress marker %q: %v", path, err)
+	}
+	// without a netns to reach, e.g. when it was passed as an "fd:"
+	// reference or is gone, the links went away with it or cannot be found
+	netnsPath, err := resolvePersistentNetns(marker.Netns, marker.NetnsInode)
+	if err != nil {
+		return fmt.Errorf("failed to clean up interrupted ADD: %v", err)
+	}
+	if netnsPath != "" {
+		if err := removeLinks(netnsPath, marker.Links); err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return fmt.Errorf("failed to clean up interrupted ADD: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// fileReplaced reports whether path no longer names the open file f.
+func fileReplaced(f *os.File, path string) (bool, error) {
+	open, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !os.SameFile(open, current), nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+func getMTUByName(ifName string) (int, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+// getLowerDeviceMTU returns the MTU of the lower device of the device named
+// deviceID, or 0 when it has none.
+func getLowerDeviceMTU(deviceID string) (int, error) {
+	link, err := netlink.LinkByName(deviceID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup device %q: %v", deviceID, err)
+	}
+	parentIndex := link.Attrs().ParentIndex
+	if parentIndex == 0 {
+		return 0, nil
+	}
+	parent, err := netlink.LinkByIndex(parentIndex)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup the lower device of %q: %v", deviceID, err)
+	}
+	return parent.Attrs().MTU, nil
+}
+
+// CreateMacvtap creates a macvtap on top of conf.Master inside netns and
+// names it ifName.
+func CreateMacvtap(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	macvlan := &current.Interface{Name: ifName}
+
+	mode, err := ModeFromString(conf.Mode)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	m, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)}
+	}
+
+	if !conf.Force {
+		if err := validateMasterKind(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Attrs().TxQLen == 0 {
+		warnf("master %q has txqlen 0, which the macvtap inherits", conf.Master)
+	}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out, unless the kernel
+	// is known to be fixed
+	tmpName := ifName
+	if !conf.DirectCreate {
+		tmpName, err = ip.RandomVethName()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mv := &netlink.Macvtap{
+		Macvlan: netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{
+				MTU:         conf.MTU,
+				Name:        tmpName,
+				ParentIndex: m.Attrs().Index,
+				Namespace:   netlink.NsFd(int(netns.Fd())),
+				TxQLen:      m.Attrs().TxQLen,
+			},
+			Mode: mode,
+		},
+	}
+	if err = injectFault(faultLinkAdd); err == nil {
+		err = netlink.LinkAdd(mv)
+	}
+	if err == syscall.EOPNOTSUPP {
+		if !conf.AutoLoadModule {
+			return nil, fmt.Errorf("failed to create macvtap: %v (is the %s kernel module loaded? see \"autoLoadModule\")", err, macvtapModule)
+		}
+		if err := loadMacvtapModule(); err != nil {
+			return nil, err
+		}
+		err = netlink.LinkAdd(mv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create macvtap: %v", err)
+	}
+	trackLink("", tmpName)
+
+	err = configureArp(conf, mv, netns)
+	if err != nil {
+		return nil, err
+	}
+	err = updateMacvtapIface(mv, macvlan, ifName, netns)
+	if err != nil {
+		return nil, err
+	}
+	return macvlan, nil
+}
+
+func boolSysctlValue(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func configureArp(conf *NetConf, macvtapConfig netlink.Link, netns ns.NetNS) error {
+	err := netns.Do(func(_ ns.NetNS) error {
+		// For sysctl, dots are replaced with forward slashes
+		name := strings.Replace(macvtapConfig.Attrs().Name, ".", "/", -1)
+
+		// TODO: duplicate following lines for ipv6 support, when it will be added in other places
+		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, name)
+		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
+			// remove the newly added link and ignore errors, because we already are in a failed state
+			_ = netlink.LinkDel(macvtapConfig)
+			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", macvtapConfig.Attrs().Name, err)
+		}
+
+		optionalSysctls := []struct {
+			template string
+			value    *bool
+		}{
+			{IPv4InterfaceArpNotifySysctlTemplate, conf.ArpNotify},
+			{IPv4InterfaceDropGratuitousArpSysctlTemplate, conf.DropGratuitousArp},
+		}
+		for _, setting := range optionalSysctls {
+			if setting.value == nil {
+				continue
+			}
+			sysctlValueName := fmt.Sprintf(setting.template, name)
+			err := injectFault(faultSysctl)
+			if err == nil {
+				_, err = sysctl.Sysctl(sysctlValueName, boolSysctlValue(*setting.value))
+			}
+			if err != nil {
+				// remove the newly added link and ignore errors, because we already are in a failed state
+				_ = netlink.LinkDel(macvtapConfig)
+				return fmt.Errorf("failed to set %s on interface %q: %v", sysctlValueName, macvtapConfig.Attrs().Name, err)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// configureAddressFamilies silences the address families disabled in the
+// configuration, so that pods on single-family networks send no unwanted
+// RS/DAD or ARP traffic.
+func configureAddressFamilies(conf *NetConf, ifName string, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		// For sysctl, dots are replaced with forward slashes
+		name := strings.Replace(ifName, ".", "/", -1)
+
+		if conf.EnableIPv6 != nil && !*conf.EnableIPv6 {
+			sysctlValueName := fmt.Sprintf(IPv6InterfaceDisableSysctlTemplate, name)
+			// without IPv6 support in the kernel there is nothing to disable
+			if _, err := sysctl.Sysctl(sysctlValueName, "1"); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to set %s on interface %q: %v", sysctlValueName, ifName, err)
+			}
+		}
+		if conf.EnableIPv4 != nil && !*conf.EnableIPv4 {
+			// 8: do not reply to ARP requests for any local address
+			sysctlValueName := fmt.Sprintf(IPv4InterfaceArpIgnoreSysctlTemplate, name)
+			if _, err := sysctl.Sysctl(sysctlValueName, "8"); err != nil {
+				return fmt.Errorf("failed to set %s on interface %q: %v", sysctlValueName, ifName, err)
+			}
+		}
+		return nil
+	})
+}
+
+func updateMacvtapIface(macvtapLink netlink.Link, macvtapIface *current.Interface, ifaceName string, netns ns.NetNS) error {
+	err := netns.Do(func(_ ns.NetNS) error {
+		if macvtapLink.Attrs().Name != ifaceName {
+			err := injectFault(faultRename)
+			if err == nil {
+				err = ip.RenameLink(macvtapLink.Attrs().Name, ifaceName)
+			}
+			if err != nil {
+				_ = netlink.LinkDel(macvtapLink)
+				return fmt.Errorf("failed to rename macvlan to %q: %v", ifaceName, err)
+			}
+			trackLink(macvtapLink.Attrs().Name, ifaceName)
+		}
+
+		updatedLink := macvtapLink
+		updatedLink.Attrs().Name = ifaceName
+		if err := netlink.LinkSetUp(updatedLink); err != nil {
+			return fmt.Errorf("failed to set macvtap iface up: %v", err)
+		}
+		// Re-fetch macvlan to get all properties/attributes
+		contMacvlan, err := netlink.LinkByName(ifaceName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch macvlan %q: %v", ifaceName, err)
+		}
+		macvtapIface.Mac = contMacvlan.Attrs().HardwareAddr.String()
+		macvtapIface.Sandbox = netns.Path()
+
+		return nil
+	})
+	return err
+}
+
+// ValidateDeviceType makes sure the device referenced by "deviceID" is of an
+// allowed link type and is not enslaved to another device, so that a typo in
+// the configuration cannot move an arbitrary host NIC into the pod.
+func ValidateDeviceType(link netlink.Link, allowedTypes []string) error {
+	if len(allowedTypes) == 0 {
+		allowedTypes = defaultAllowedDeviceTypes
+	}
+
+	linkType := link.Type()
+	allowed := false
+	for _, t := range allowedTypes {
+		if t == linkType {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return &ConfigError{fmt.Errorf("device %q is of type %q, must be one of %v", link.Attrs().Name, linkType, allowedTypes)}
+	}
+	if link.Attrs().MasterIndex != 0 {
+		return &ConfigError{fmt.Errorf("device %q is enslaved to another device (index %d)", link.Attrs().Name, link.Attrs().MasterIndex)}
+	}
+	return nil
+}
+
+// ValidateDeviceMode checks that an imported macvtap already operates in the
+// requested mode. The mode of an existing macvtap cannot be changed in place,
+// so a mismatch is reported instead of being silently ignored.
+func ValidateDeviceMode(link netlink.Link, requestedMode string) error {
+	if requestedMode == "" {
+		return nil
+	}
+	mode, err := ModeFromString(requestedMode)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok {
+		return &ConfigError{fmt.Errorf("cannot set mode %q on device %q of type %q", requestedMode, link.Attrs().Name, link.Type())}
+	}
+	if macvtap.Mode != mode {
+		currentMode, err := ModeToString(macvtap.Mode)
+		if err != nil {
+			return err
+		}
+		return &ConfigError{fmt.Errorf("device %q is in mode %q, but mode %q was requested", link.Attrs().Name, currentMode, requestedMode)}
+	}
+	return nil
+}
+
+// ConfigureMacvtap imports the existing device conf.DeviceID into netns and
+// names it ifName.
+func ConfigureMacvtap(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	iface, err := netlink.LinkByName(conf.DeviceID)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("failed to lookup device %q: %v", conf.DeviceID, err)}
+	}
+	if err := ValidateDeviceType(iface, conf.AllowedDeviceTypes); err != nil {
+		return nil, err
+	}
+	if err := ValidateDeviceMode(iface, conf.Mode); err != nil {
+		return nil, err
+	}
+	// like a created macvtap, the imported one inherits the txqlen of its
+	// lower device
+	txQLen := iface.Attrs().TxQLen
+	if parentIndex := iface.Attrs().ParentIndex; parentIndex != 0 {
+		parent, err := netlink.LinkByIndex(parentIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup the lower device of %q: %v", conf.DeviceID, err)
+		}
+		txQLen = parent.Attrs().TxQLen
+	}
+
+	if err := netlink.LinkSetNsFd(iface, int(netns.Fd())); err != nil {
+		return nil, fmt.Errorf("failed to move iface %s to the netns %d because: %v", iface, netns.Fd(), err)
+	}
+	trackLink("", iface.Attrs().Name)
+	err = netns.Do(func(_ ns.NetNS) error {
+		if conf.MTU > 0 {
+			if err := netlink.LinkSetMTU(iface, conf.MTU); err != nil {
+				return fmt.Errorf("failed to set the macvtap MTU for %s: %v", conf.DeviceID, err)
+			}
+		}
+		if err := netlink.LinkSetTxQLen(iface, txQLen); err != nil {
+			return fmt.Errorf("failed to set the macvtap txqlen for %s: %v", conf.DeviceID, err)
+		}
+		// a created macvtap is not promiscuous, so reset leftovers from a
+		// previous user of the device
+		if iface.Attrs().Promisc != 0 {
+			if err := netlink.SetPromiscOff(iface); err != nil {
+				return fmt.Errorf("failed to disable promiscuous mode for %s: %v", conf.DeviceID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	macvtap := &current.Interface{Name: ifName}
+	err = configureArp(conf, iface, netns)
+	if err != nil {
+		return nil, err
+	}
+	err = updateMacvtapIface(iface, macvtap, ifName, netns)
+	if err != nil {
+		return nil, err
+	}
+	return macvtap, err
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// linkLockDir holds one advisory lock file per host link. CNI plugins sharing
+// a parent link (e.g. macvtap, sriov and bond) flock(2) <linkLockDir>/<link>
+// exclusively around the operations mutating it, so they do not race.
+var linkLockDir = "/run/cni/link-locks"
+
+// lockLink blocks until it holds the advisory lock of the host link name, and
+// returns the function releasing it, which may be called more than once.
+func lockLink(name string) (func(), error) {
+	if err := os.MkdirAll(linkLockDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create link lock dir %q: %v", linkLockDir, err)
+	}
+	path := filepath.Join(linkLockDir, name)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open link lock %q: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock link lock %q: %v", path, err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		})
+	}, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	masterResolveAttempts = 3
+	masterResolveInterval = 200 * time.Millisecond
+)
+
+// sysClassNet is where the kernel exposes the attributes of the host links.
+var sysClassNet = "/sys/class/net"
+
+// resolveMaster looks up the master by name and, when it cannot be found,
+// falls back to the recorded "masterIndex" or "masterMAC", retrying a few
+// times. This survives the master being renamed by udev or NetworkManager
+// while the plugin runs. On success conf.Master holds the current name.
+func resolveMaster(conf *NetConf) error {
+	var err error
+	for attempt := 0; attempt < masterResolveAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(masterResolveInterval)
+		}
+
+		var link netlink.Link
+		link, err = findMaster(conf)
+		if err == nil {
+			conf.Master = link.Attrs().Name
+			return nil
+		}
+	}
+	return err
+}
+
+func findMaster(conf *NetConf) (netlink.Link, error) {
+	link, err := netlink.LinkByName(conf.Master)
+	if err == nil {
+		return link, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+	notFound := fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+
+	var byIndex netlink.Link
+	if conf.MasterIndex > 0 {
+		byIndex, _ = netlink.LinkByIndex(conf.MasterIndex)
+	}
+	if conf.MasterMAC == "" {
+		if byIndex != nil {
+			return byIndex, nil
+		}
+		return nil, notFound
+	}
+	hwAddr, err := net.ParseMAC(conf.MasterMAC)
+	if err != nil {
+		return nil, err
+	}
+	if byIndex != nil {
+		// the ifindex may have been reused since the master went away
+		if !linkHasMAC(byIndex, hwAddr) {
+			return nil, fmt.Errorf("failed to lookup master %q: ifindex %d now belongs to %q, whose MAC address is not %s", conf.Master, conf.MasterIndex, byIndex.Attrs().Name, hwAddr)
+		}
+		return byIndex, nil
+	}
+	link, err = linkByMAC(hwAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+	return link, nil
+}
+
+// permAddr returns the permanent hardware address of the link, if it has
+// one.
+func permAddr(link netlink.Link) net.HardwareAddr {
+	addr, err := ethtool.PermAddr(link.Attrs().Name)
+	if err != nil || addr == "" {
+		return nil
+	}
+	hwAddr, err := net.ParseMAC(addr)
+	if err != nil {
+		return nil
+	}
+	return hwAddr
+}
+
+func linkHasMAC(link netlink.Link, hwAddr net.HardwareAddr) bool {
+	return permAddr(link).String() == hwAddr.String() || link.Attrs().HardwareAddr.String() == hwAddr.String()
+}
+
+// isPhysical reports whether the link is backed by a device, unlike VLANs,
+// bonds or macvlans, which usually share the MAC address of their lower
+// device.
+func isPhysical(name string) bool {
+	_, err := os.Stat(filepath.Join(sysClassNet, name, "device"))
+	return err == nil
+}
+
+// linkByMAC returns the link whose permanent hardware address is hwAddr or,
+// for a physical device not enslaved to a bond, whose current one is. More
+// than one such link is an error rather than a guess.
+func linkByMAC(hwAddr net.HardwareAddr) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var matches []netlink.Link
+	for _, link := range links {
+		if permAddr(link).String() == hwAddr.String() {
+			matches = append(matches, link)
+			continue
+		}
+		attrs := link.Attrs()
+		if attrs.HardwareAddr.String() == hwAddr.String() && attrs.MasterIndex == 0 && isPhysical(attrs.Name) {
+			matches = append(matches, link)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no link with hardware address %s", hwAddr)
+	case 1:
+		return matches[0], nil
+	default:
+		names := []string{}
+		for _, link := range matches {
+			names = append(names, link.Attrs().Name)
+		}
+		return nil, fmt.Errorf("hardware address %s is ambiguous, it matches %s", hwAddr, strings.Join(names, ", "))
+	}
+}
+
+// isWireless reports whether the link is an 802.11 device.
+func isWireless(name string) bool {
+	for _, attr := range []string{"wireless", "phy80211"} {
+		if _, err := os.Stat(filepath.Join(sysClassNet, name, attr)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMasterKind rejects masters a macvtap cannot work on top of, and
+// explains what to use instead. The kernel either refuses these with an
+// opaque error or, worse, accepts them and silently drops the traffic.
+func validateMasterKind(master netlink.Link) error {
+	name := master.Attrs().Name
+	if master.Attrs().EncapType == "loopback" {
+		return &ConfigError{fmt.Errorf("macvtap cannot parent on the loopback device %q; use a wired NIC", name)}
+	}
+	if isWireless(name) {
+		return &ConfigError{fmt.Errorf("macvtap cannot parent on the wireless device %q, which drops frames for other MAC addresses; use a wired NIC or a bridge backend (see \"force\")", name)}
+	}
+	// netlink reads tun and tap devices back as generic "tun" links, only
+	// the latter carry ethernet frames
+	if master.Type() == "tun" && master.Attrs().EncapType != "ether" {
+		return &ConfigError{fmt.Errorf("macvtap cannot parent on the tun device %q, which carries no ethernet frames; use a wired NIC or a tap device", name)}
+	}
+	switch link := master.(type) {
+	case *netlink.Macvlan, *netlink.Macvtap:
+		return &ConfigError{fmt.Errorf("macvtap cannot parent on the %s device %q, the kernel would attach it to the lower device instead; use that device as master (see \"force\")", link.Type(), name)}
+	}
+	return nil
+}
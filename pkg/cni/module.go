@@ -0,0 +1,39 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const (
+	macvtapModule         = "macvtap"
+	modulesDisabledSysctl = "/proc/sys/kernel/modules_disabled"
+)
+
+// loadMacvtapModule loads the macvtap kernel module, which minimal operating
+// systems may not load on their own.
+func loadMacvtapModule() error {
+	if data, err := ioutil.ReadFile(modulesDisabledSysctl); err == nil && strings.TrimSpace(string(data)) == "1" {
+		return fmt.Errorf("cannot load the %s kernel module: module loading is disabled on this node (%s)", macvtapModule, modulesDisabledSysctl)
+	}
+	if out, err := exec.Command("modprobe", macvtapModule).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load the %s kernel module: %v: %s", macvtapModule, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// ResolveNetns turns a netns reference into a path ns.GetNS can open.
+// Besides bind-mount paths, it accepts "pid:<pid>", the netns of a process,
+// and "fd:<fd>", a netns file descriptor inherited by the plugin, for
+// integrations that do not create named netns files.
+func ResolveNetns(ref string) (string, error) {
+	for prefix, format := range map[string]string{
+		"pid:": "/proc/%d/ns/net",
+		"fd:":  "/proc/self/fd/%d",
+	} {
+		if !strings.HasPrefix(ref, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(ref, prefix))
+		if err != nil || n < 0 || (prefix == "pid:" && n == 0) {
+			return "", fmt.Errorf("invalid netns reference %q", ref)
+		}
+		return fmt.Sprintf(format, n), nil
+	}
+	return ref, nil
+}
+
+// netnsInode returns the inode identifying the open netns.
+func netnsInode(netns ns.NetNS) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(netns.Fd()), &st); err != nil {
+		return 0, fmt.Errorf("failed to stat netns %q: %v", netns.Path(), err)
+	}
+	return st.Ino, nil
+}
+
+// persistentNetns returns how the netns reference ref, open as netns, is
+// persisted for later commands and other processes. Bind-mount paths are kept
+// as they are. A "pid:" reference is kept along with the inode of the netns,
+// since the pid may be reused once the container exits. An "fd:" reference
+// means nothing outside the plugin process, so only the inode is kept.
+func persistentNetns(ref string, netns ns.NetNS) (string, uint64, error) {
+	if !strings.HasPrefix(ref, "pid:") && !strings.HasPrefix(ref, "fd:") {
+		return ref, 0, nil
+	}
+	inode, err := netnsInode(netns)
+	if err != nil {
+		return "", 0, err
+	}
+	if strings.HasPrefix(ref, "fd:") {
+		return "", inode, nil
+	}
+	return ref, inode, nil
+}
+
+// resolvePersistentNetns returns the path of a netns persisted by
+// persistentNetns, or "" when it cannot be reached anymore or the reference
+// now points to another netns.
+func resolvePersistentNetns(ref string, inode uint64) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	path, err := ResolveNetns(ref)
+	if err != nil {
+		return "", err
+	}
+	if inode == 0 {
+		return path, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		if err == unix.ENOENT || err == unix.ESRCH {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to stat netns %q: %v", path, err)
+	}
+	if st.Ino != inode {
+		return "", nil
+	}
+	return path, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const nftTablePrefix = "macvtap-"
+
+// PortRule selects an L4 port on the macvtap interface.
+type PortRule struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+func validatePortRules(rules []PortRule) error {
+	for _, rule := range rules {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return fmt.Errorf("invalid port rule protocol %q, must be tcp or udp", rule.Protocol)
+		}
+		if rule.Port <= 0 || rule.Port > 65535 {
+			return fmt.Errorf("invalid port %d, must be [1, 65535]", rule.Port)
+		}
+	}
+	return nil
+}
+
+func hasPortRules(conf *NetConf) bool {
+	return len(conf.AllowedPorts) > 0 || len(conf.BlockedPorts) > 0
+}
+
+func nftTableName(ifName string) string {
+	return nftTablePrefix + ifName
+}
+
+// validatePortRulesConsumer rejects port rules on networks whose interfaces
+// are consumed through their tap device: frames read from /dev/tapN never
+// traverse the netns IP stack, so nftables cannot filter them.
+func validatePortRulesConsumer(conf *NetConf) error {
+	if !hasPortRules(conf) {
+		return nil
+	}
+	if conf.TapDeviceProvisioning == tapProvisioningWaitDevtmpfs || conf.HandoffDir != "" {
+		return fmt.Errorf(`"allowedPorts" and "blockedPorts" only filter traffic of netdev consumers, and cannot be used with a tap consumer ("tapDeviceProvisioning", "handoffDir")`)
+	}
+	return nil
+}
+
+// renderPortRules builds an nftables ruleset filtering inbound traffic on
+// ifName. Replies to connections opened from the container are always
+// accepted. Blocked ports are always dropped; when allowed ports are given,
+// any other tcp or udp traffic is dropped as well.
+func renderPortRules(ifName string, allowed []PortRule, blocked []PortRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", nftTableName(ifName))
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ct state established,related accept\n", ifName)
+	for _, rule := range blocked {
+		fmt.Fprintf(&b, "\t\tiifname %q %s dport %d drop\n", ifName, rule.Protocol, rule.Port)
+	}
+	if len(allowed) > 0 {
+		for _, rule := range allowed {
+			fmt.Fprintf(&b, "\t\tiifname %q %s dport %d accept\n", ifName, rule.Protocol, rule.Port)
+		}
+		fmt.Fprintf(&b, "\t\tiifname %q meta l4proto { tcp, udp } drop\n", ifName)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func runNft(input string, args ...string) error {
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft %s failed: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
+
+func installPortRules(conf *NetConf, ifName string, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		return runNft(renderPortRules(ifName, conf.AllowedPorts, conf.BlockedPorts), "-f", "-")
+	})
+}
+
+func removePortRules(ifName string) error {
+	return runNft("", "delete", "table", "inet", nftTableName(ifName))
+}
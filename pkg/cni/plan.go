@@ -0,0 +1,70 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// planInterfaces validates an ADD with "attach" disabled and returns the
+// interfaces it would produce, without creating, moving or modifying any
+// link. The MAC address is only known when requested through CNI_ARGS.
+func planInterfaces(conf *NetConf, envArgs EnvArgs, ifNames []string, netnsPath string) ([]*current.Interface, error) {
+	if conf.DeviceID != "" {
+		link, err := netlink.LinkByName(conf.DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup device %q: %v", conf.DeviceID, err)
+		}
+		if err := ValidateDeviceType(link, conf.AllowedDeviceTypes); err != nil {
+			return nil, err
+		}
+		if err := ValidateDeviceMode(link, conf.Mode); err != nil {
+			return nil, err
+		}
+	} else {
+		master, err := netlink.LinkByName(conf.Master)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+		}
+		if !conf.Force {
+			if err := validateMasterKind(master); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var mac net.HardwareAddr
+	if envArgs.MAC != "" {
+		var err error
+		if mac, err = net.ParseMAC(string(envArgs.MAC)); err != nil {
+			return nil, err
+		}
+	}
+
+	var interfaces []*current.Interface
+	for i, ifName := range ifNames {
+		iface := &current.Interface{Name: ifName, Sandbox: netnsPath}
+		if mac != nil {
+			iface.Mac = offsetMAC(mac, i).String()
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
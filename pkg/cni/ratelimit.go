@@ -0,0 +1,121 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// ErrTryAgainLater is the CNI error code asking the runtime to retry the
+// operation later.
+const ErrTryAgainLater uint = 11
+
+// RateLimit bounds how many ADDs per second may create macvtaps on the same
+// master, so mass pod creation does not flood the switch with MAC moves.
+type RateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+// tokenBucket is the per master rate limiting state, shared by all plugin
+// invocations through a file in the state directory.
+type tokenBucket struct {
+	Tokens float64 `json:"tokens"`
+	Last   int64   `json:"last"`
+}
+
+func validateRateLimit(limit *RateLimit) error {
+	if limit == nil {
+		return nil
+	}
+	if limit.PerSecond <= 0 {
+		return fmt.Errorf("invalid addRateLimit perSecond %v, must be positive", limit.PerSecond)
+	}
+	if limit.Burst < 1 {
+		return fmt.Errorf("invalid addRateLimit burst %d, must be at least 1", limit.Burst)
+	}
+	return nil
+}
+
+// takeAddTokens consumes count tokens from the bucket of master, returning
+// an ErrTryAgainLater error, and consuming none, when it holds fewer.
+func takeAddTokens(stateDir string, master string, limit *RateLimit, count int, now time.Time) error {
+	dir := filepath.Join(stateDir, "ratelimit")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create rate limit dir %q: %v", dir, err)
+	}
+
+	path := filepath.Join(dir, master)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open rate limit state %q: %v", path, err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock rate limit state %q: %v", path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	bucket := tokenBucket{Tokens: float64(limit.Burst), Last: now.UnixNano()}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read rate limit state %q: %v", path, err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &bucket); err != nil {
+			return fmt.Errorf("failed to parse rate limit state %q: %v", path, err)
+		}
+	}
+
+	elapsed := now.Sub(time.Unix(0, bucket.Last)).Seconds()
+	if elapsed > 0 {
+		bucket.Tokens += elapsed * limit.PerSecond
+	}
+	if bucket.Tokens > float64(limit.Burst) {
+		bucket.Tokens = float64(limit.Burst)
+	}
+	bucket.Last = now.UnixNano()
+
+	limited := bucket.Tokens < float64(count)
+	if !limited {
+		bucket.Tokens -= float64(count)
+	}
+
+	if data, err = json.Marshal(bucket); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write rate limit state %q: %v", path, err)
+	}
+
+	if limited {
+		return &types.Error{
+			Code: ErrTryAgainLater,
+			Msg:  fmt.Sprintf("too many macvtaps created on master %q, try again later", master),
+		}
+	}
+	return nil
+}
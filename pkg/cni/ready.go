@@ -0,0 +1,94 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const readyPollInterval = 50 * time.Millisecond
+
+// WaitReady makes ADD block until the interface can actually be used.
+type WaitReady struct {
+	// Timeout is a duration string, e.g. "5s".
+	Timeout string `json:"timeout"`
+}
+
+func parseWaitReadyTimeout(waitReady *WaitReady) (time.Duration, error) {
+	timeout, err := time.ParseDuration(waitReady.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid waitReady timeout %q: %v", waitReady.Timeout, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid waitReady timeout %q, must be positive", waitReady.Timeout)
+	}
+	return timeout, nil
+}
+
+// linkReady reports whether link is operationally up and none of its IPv6
+// addresses is still undergoing duplicate address detection.
+func linkReady(link netlink.Link) (bool, error) {
+	// virtual devices which do not track their operational state report
+	// "unknown" even when usable
+	operState := link.Attrs().OperState
+	if operState != netlink.OperUp && operState != netlink.OperUnknown {
+		return false, nil
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return false, fmt.Errorf("failed to list addresses of %q: %v", link.Attrs().Name, err)
+	}
+	for _, addr := range addrs {
+		if addr.Flags&syscall.IFA_F_DADFAILED != 0 {
+			return false, fmt.Errorf("duplicate address detection failed for %s on %q", addr.IPNet, link.Attrs().Name)
+		}
+		if addr.Flags&syscall.IFA_F_TENTATIVE != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// waitForLinkReady polls ifName inside netns until it is ready or the
+// timeout expires.
+func waitForLinkReady(ifName string, netns ns.NetNS, timeout time.Duration) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		deadline := time.Now().Add(timeout)
+		for {
+			link, err := netlink.LinkByName(ifName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+			}
+			ready, err := linkReady(link)
+			if err != nil {
+				return err
+			}
+			if ready {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("interface %q not ready after %v (operstate %s)", ifName, timeout, link.Attrs().OperState)
+			}
+			time.Sleep(readyPollInterval)
+		}
+	})
+}
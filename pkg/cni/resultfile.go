@@ -0,0 +1,108 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func validateResultFile(template string) error {
+	if strings.Count(template, "%") != 1 || strings.Count(template, "%s") != 1 {
+		return fmt.Errorf(`invalid resultFile %q, must contain "%%s" once`, template)
+	}
+	if strings.Contains(filepath.Dir(template), "%s") {
+		return fmt.Errorf(`invalid resultFile %q, "%%s" must be in the file name`, template)
+	}
+	return nil
+}
+
+func resultFilePath(template, containerID, ifName string) string {
+	return fmt.Sprintf(template, fmt.Sprintf("%s-%s", containerID, ifName))
+}
+
+// writeResultFile stores the ADD result, encoded like the one printed to the
+// runtime, for consumers that are not CNI runtimes. The file is renamed into
+// place so readers never see a partial result.
+func writeResultFile(template, containerID, ifName string, result *current.Result, cniVersion string) error {
+	data, err := encodeResult(result, cniVersion)
+	if err != nil {
+		return err
+	}
+	path := resultFilePath(template, containerID, ifName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create result dir: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".result")
+	if err != nil {
+		return fmt.Errorf("failed to write result file %q: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write result file %q: %v", path, err)
+	}
+	return nil
+}
+
+func removeResultFile(template, containerID, ifName string) error {
+	if template == "" {
+		return nil
+	}
+	if err := os.Remove(resultFilePath(template, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeStaleResultFiles removes the result files matching template whose
+// attachment is not in valid, leaving any other file in their dir alone.
+func removeStaleResultFiles(template string, valid map[string]bool) error {
+	pattern := strings.Replace(template, "%s", "*", 1)
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	prefix, suffix := splitTemplate(filepath.Base(template))
+	for _, path := range paths {
+		attachment := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), suffix)
+		if valid[attachment+".json"] {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitTemplate(template string) (string, string) {
+	parts := strings.SplitN(template, "%s", 2)
+	return parts[0], parts[1]
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// Schema is the JSON Schema of the plugin configuration. It is the single
+// source of truth for the accepted fields, shared with UIs and admission
+// webhooks through the --schema flag.
+const Schema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "macvtap CNI plugin configuration",
+  "type": "object",
+  "properties": {
+    "cniVersion": {"type": "string"},
+    "name": {"type": "string"},
+    "type": {"type": "string"},
+    "master": {"type": "string"},
+    "masterIndex": {"type": "integer", "minimum": 1},
+    "masterMAC": {"type": "string"},
+    "mode": {"type": "string", "enum": ["", "bridge", "private", "vepa"]},
+    "mtu": {"type": "integer", "minimum": 0},
+    "deviceID": {"type": "string"},
+    "allowedDeviceTypes": {"type": "array", "items": {"type": "string"}},
+    "allowedPorts": {"type": "array", "items": {"$ref": "#/definitions/portRule"}},
+    "blockedPorts": {"type": "array", "items": {"$ref": "#/definitions/portRule"}},
+    "warningsDir": {"type": "string"},
+    "stateDir": {"type": "string"},
+    "addRateLimit": {
+      "type": "object",
+      "properties": {
+        "perSecond": {"type": "number"},
+        "burst": {"type": "integer", "minimum": 1}
+      },
+      "required": ["perSecond", "burst"]
+    },
+    "arpNotify": {"type": "boolean"},
+    "dropGratuitousArp": {"type": "boolean"},
+    "interfaces": {"type": "integer", "minimum": 0, "maximum": 16},
+    "autoLoadModule": {"type": "boolean"},
+    "alignMtuWithPrevResult": {"type": "boolean"},
+    "waitReady": {
+      "type": "object",
+      "properties": {
+        "timeout": {"type": "string"}
+      },
+      "required": ["timeout"]
+    },
+    "hooks": {
+      "type": "object",
+      "properties": {
+        "postAdd": {"type": "array", "items": {"$ref": "#/definitions/hook"}},
+        "postDel": {"type": "array", "items": {"$ref": "#/definitions/hook"}}
+      }
+    },
+    "ifGroup": {"type": "integer", "minimum": 0, "maximum": 4294967295},
+    "handoffDir": {"type": "string"},
+    "force": {"type": "boolean"},
+    "vrf": {"type": "string"},
+    "vrfTable": {"type": "integer", "minimum": 0, "maximum": 4294967295},
+    "macOUI": {"type": "string"},
+    "attach": {"type": "boolean"},
+    "directCreate": {"type": "boolean"},
+    "failOnUnknownArgs": {"type": "boolean"},
+    "allowMacOverride": {"type": "boolean"},
+    "gsoMaxSize": {"type": "integer", "minimum": 0, "maximum": 4294967295},
+    "gsoMaxSegs": {"type": "integer", "minimum": 0, "maximum": 65535},
+    "tapDeviceProvisioning": {"type": "string", "enum": ["", "none", "wait-devtmpfs"]},
+    "tapDeviceTimeout": {"type": "string"},
+    "preferAllocatedDevice": {"type": "boolean"},
+    "vlan": {"type": "integer", "minimum": 0, "maximum": 4094},
+    "verifyMac": {"type": "boolean"},
+    "enableIPv4": {"type": "boolean"},
+    "enableIPv6": {"type": "boolean"},
+    "failuresDir": {"type": "string"},
+    "resultFile": {"type": "string"},
+    "description": {"type": "string", "maxLength": 128},
+    "runtimeConfig": {
+      "type": "object",
+      "properties": {
+        "mode": {"type": "string", "enum": ["", "bridge", "private", "vepa"]}
+      }
+    },
+    "args": {
+      "type": "object",
+      "properties": {
+        "cni": {
+          "type": "object",
+          "properties": {
+            "mac": {"type": "string"},
+            "mtu": {"type": "integer", "minimum": 0},
+            "mode": {"type": "string", "enum": ["", "bridge", "private", "vepa"]}
+          }
+        }
+      }
+    }
+  },
+  "definitions": {
+    "hook": {
+      "type": "object",
+      "properties": {
+        "exec": {"type": "string"},
+        "url": {"type": "string"}
+      }
+    },
+    "portRule": {
+      "type": "object",
+      "properties": {
+        "protocol": {"type": "string", "enum": ["tcp", "udp"]},
+        "port": {"type": "integer", "minimum": 1, "maximum": 65535}
+      },
+      "required": ["protocol", "port"]
+    }
+  }
+}`
+
+// schemaNode is the subset of JSON Schema used by Schema.
+type schemaNode struct {
+	Ref         string                 `json:"$ref"`
+	Type        string                 `json:"type"`
+	Properties  map[string]*schemaNode `json:"properties"`
+	Items       *schemaNode            `json:"items"`
+	Enum        []interface{}          `json:"enum"`
+	Minimum     *float64               `json:"minimum"`
+	Maximum     *float64               `json:"maximum"`
+	MaxLength   *int                   `json:"maxLength"`
+	Required    []string               `json:"required"`
+	Definitions map[string]*schemaNode `json:"definitions"`
+}
+
+var parsedSchema *schemaNode
+
+func loadSchema() (*schemaNode, error) {
+	if parsedSchema == nil {
+		root := &schemaNode{}
+		if err := json.Unmarshal([]byte(Schema), root); err != nil {
+			return nil, fmt.Errorf("failed to parse the configuration schema: %v", err)
+		}
+		parsedSchema = root
+	}
+	return parsedSchema, nil
+}
+
+// validateAgainstSchema checks the raw configuration against Schema,
+// reporting the path of the first offending field.
+func validateAgainstSchema(bytes []byte) error {
+	root, err := loadSchema()
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(bytes, &value); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	return root.validate(root, value, "")
+}
+
+func (s *schemaNode) validate(root *schemaNode, value interface{}, path string) error {
+	if s.Ref != "" {
+		const prefix = "#/definitions/"
+		def, ok := root.Definitions[s.Ref[len(prefix):]]
+		if !ok {
+			return fmt.Errorf("unknown schema reference %q", s.Ref)
+		}
+		return def.validate(root, value, path)
+	}
+
+	if err := checkType(s.Type, value); err != nil {
+		return fieldError(path, err.Error())
+	}
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		return fieldError(path, fmt.Sprintf("must be one of %v", s.Enum))
+	}
+	if number, ok := value.(float64); ok {
+		if s.Minimum != nil && number < *s.Minimum {
+			return fieldError(path, fmt.Sprintf("must be at least %v", *s.Minimum))
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			return fieldError(path, fmt.Sprintf("must be at most %v", *s.Maximum))
+		}
+	}
+
+	// counted in characters, as JSON Schema does
+	if str, ok := value.(string); ok && s.MaxLength != nil && utf8.RuneCountInString(str) > *s.MaxLength {
+		return fieldError(path, fmt.Sprintf("must be at most %d characters long", *s.MaxLength))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fieldError(joinPath(path, name), "is required")
+			}
+		}
+		// iterate in a stable order so the reported error is deterministic
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// unknown fields are allowed, runtimes add their own
+			if property, ok := s.Properties[name]; ok {
+				if err := property.validate(root, v[name], joinPath(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(root, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkType(schemaType string, value interface{}) error {
+	ok := true
+	switch schemaType {
+	case "":
+		return nil
+	case "object":
+		_, ok = value.(map[string]interface{})
+	case "array":
+		_, ok = value.([]interface{})
+	case "string":
+		_, ok = value.(string)
+	case "boolean":
+		_, ok = value.(bool)
+	case "number":
+		_, ok = value.(float64)
+	case "integer":
+		number, isNumber := value.(float64)
+		ok = isNumber && number == math.Trunc(number)
+	}
+	if !ok {
+		return fmt.Errorf("must be of type %s", schemaType)
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func fieldError(path, msg string) error {
+	return fmt.Errorf("invalid configuration: %q %s", path, msg)
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// ErrPluginNotAvailable is the CNI error code STATUS returns when the plugin
+// cannot currently serve ADD requests.
+const ErrPluginNotAvailable uint = 50
+
+func notAvailable(format string, args ...interface{}) error {
+	return &types.Error{
+		Code: ErrPluginNotAvailable,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// CmdStatus implements the CNI STATUS command: it verifies that the
+// configured master exists, that macvtaps can be created, and that the state
+// dir is writable.
+func CmdStatus(stdinData []byte) error {
+	n, _, err := LoadConf(stdinData)
+	if err != nil {
+		return &ConfigError{err}
+	}
+
+	if n.Master != "" {
+		if _, err := findMaster(n); err != nil {
+			return notAvailable("master unavailable: %v", err)
+		}
+	}
+
+	if err := probeMacvtap(); err == syscall.EOPNOTSUPP {
+		// like ADD, only fail when the module would not be loaded on demand
+		if !n.AutoLoadModule {
+			return notAvailable("the kernel does not support macvtap links, is the %s kernel module loaded?", macvtapModule)
+		}
+	} else if err != nil {
+		return notAvailable("failed to probe for macvtap support: %v", err)
+	}
+
+	if err := os.MkdirAll(n.StateDir, 0755); err != nil {
+		return notAvailable("state dir %q unavailable: %v", n.StateDir, err)
+	}
+	probe, err := ioutil.TempFile(n.StateDir, ".status")
+	if err != nil {
+		return notAvailable("state dir %q is not writable: %v", n.StateDir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// macvtapProbeName names the link probeMacvtap asks the kernel to create.
+const macvtapProbeName = "mvtap-probe"
+
+// probeMacvtap asks the kernel for a macvtap without a lower device, which
+// it refuses with EINVAL when it supports macvtap links, whether built in
+// or as a loaded module, and with EOPNOTSUPP when it does not.
+func probeMacvtap() error {
+	probe := &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: macvtapProbeName}}}
+	err := netlink.LinkAdd(probe)
+	switch err {
+	case syscall.EINVAL:
+		return nil
+	case nil:
+		// never expected, but do not leave the link behind
+		return netlink.LinkDel(probe)
+	}
+	return err
+}
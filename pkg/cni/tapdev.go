@@ -0,0 +1,88 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// How the tap character device of a macvtap is made available on the node.
+const (
+	// tapProvisioningNone leaves it to the kernel and udev.
+	tapProvisioningNone = "none"
+	// tapProvisioningWaitDevtmpfs makes ADD wait until devtmpfs exposes it.
+	tapProvisioningWaitDevtmpfs = "wait-devtmpfs"
+)
+
+const defaultTapDeviceTimeout = 5 * time.Second
+
+func validateTapDeviceProvisioning(conf *NetConf) error {
+	switch conf.TapDeviceProvisioning {
+	case "", tapProvisioningNone, tapProvisioningWaitDevtmpfs:
+	default:
+		return fmt.Errorf("invalid tapDeviceProvisioning %q, must be one of %q, %q", conf.TapDeviceProvisioning, tapProvisioningNone, tapProvisioningWaitDevtmpfs)
+	}
+	_, err := parseTapDeviceTimeout(conf)
+	return err
+}
+
+func parseTapDeviceTimeout(conf *NetConf) (time.Duration, error) {
+	if conf.TapDeviceTimeout == "" {
+		return defaultTapDeviceTimeout, nil
+	}
+	timeout, err := time.ParseDuration(conf.TapDeviceTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tapDeviceTimeout %q: %v", conf.TapDeviceTimeout, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid tapDeviceTimeout %q, must be positive", conf.TapDeviceTimeout)
+	}
+	return timeout, nil
+}
+
+// waitForTapDevice polls until the tap device of ifName shows up, or the
+// timeout expires.
+func waitForTapDevice(ifName string, netns ns.NetNS, timeout time.Duration) error {
+	var ifIndex int
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		ifIndex = link.Attrs().Index
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	path := TapDevicePath(ifIndex)
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tap device %s of %q did not show up within %v", path, ifName, timeout)
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// SupportedVersions lists the CNI spec versions the plugin implements. The
+// vendored CNI library stops at 0.4.0, whose results only differ from the
+// 1.x ones by the "version" of their IPs, so the plugin converts between
+// them itself.
+var SupportedVersions = version.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0")
+
+// isV1 reports whether cniVersion is a 1.x spec version.
+func isV1(cniVersion string) bool {
+	v1, err := version.GreaterThanOrEqualTo(cniVersion, "1.0.0")
+	return err == nil && v1
+}
+
+// encodeResult encodes result the way the spec version cniVersion defines.
+func encodeResult(result *current.Result, cniVersion string) ([]byte, error) {
+	if !isV1(cniVersion) {
+		versioned, err := result.GetAsVersion(cniVersion)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(versioned)
+	}
+
+	r := *result
+	r.CNIVersion = current.ImplementedSpecVersion
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	raw["cniVersion"] = cniVersion
+	ips, _ := raw["ips"].([]interface{})
+	for _, ip := range ips {
+		if ip, ok := ip.(map[string]interface{}); ok {
+			delete(ip, "version")
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// printResult prints result to stdout for the runtime, like
+// types.PrintResult does for the spec versions the CNI library supports.
+func printResult(result *current.Result, cniVersion string) error {
+	if !isV1(cniVersion) {
+		return types.PrintResult(result, cniVersion)
+	}
+	data, err := encodeResult(result, cniVersion)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// parsePrevResult parses the prevResult of conf, like
+// version.ParsePrevResult does for the spec versions the CNI library
+// supports. A 1.x prevResult is parsed as a 0.4.0 one, once the "version" of
+// its IPs is restored.
+func parsePrevResult(conf *types.NetConf) error {
+	if conf.RawPrevResult == nil || !isV1(conf.CNIVersion) {
+		return version.ParsePrevResult(conf)
+	}
+
+	raw := map[string]interface{}{}
+	for key, value := range conf.RawPrevResult {
+		raw[key] = value
+	}
+	raw["cniVersion"] = current.ImplementedSpecVersion
+	ips, _ := raw["ips"].([]interface{})
+	for _, ip := range ips {
+		ip, ok := ip.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address, _ := ip["address"].(string)
+		addr, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("could not parse prevResult: invalid address %q", address)
+		}
+		if addr.To4() != nil {
+			ip["version"] = "4"
+		} else {
+			ip["version"] = "6"
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	conf.RawPrevResult = nil
+	if conf.PrevResult, err = current.NewResult(data); err != nil {
+		return fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	return nil
+}
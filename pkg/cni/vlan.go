@@ -0,0 +1,103 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// vlanName returns the name given to the VLAN vlanID created on master,
+// following the <master>.<vlan> convention of "ip link".
+func vlanName(master string, vlanID int) string {
+	return shortenName(master, fmt.Sprintf(".%d", vlanID))
+}
+
+// findVlan returns the VLAN vlanID on top of master whatever its name, or
+// nil when there is none.
+func findVlan(master netlink.Link, vlanID int) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if vlan, ok := link.(*netlink.Vlan); ok && vlan.ParentIndex == master.Attrs().Index && vlan.VlanId == vlanID {
+			return vlan, nil
+		}
+	}
+	return nil, nil
+}
+
+// setupVlan points conf.Master to the VLAN conf.Vlan on top of the
+// configured master. A VLAN created by another tool is adopted; a missing one
+// is created when create is set, and otherwise the macvtaps are validated
+// against the master itself. The VLAN is shared by every attachment of the
+// network, so DEL leaves it in place.
+func setupVlan(conf *NetConf, create bool) error {
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+	vlan, err := findVlan(master, conf.Vlan)
+	if err != nil {
+		return fmt.Errorf("failed to look for vlan %d on %q: %v", conf.Vlan, conf.Master, err)
+	}
+	if vlan == nil {
+		if !create {
+			return nil
+		}
+		if vlan, err = createVlan(master, conf.Vlan); err != nil {
+			return err
+		}
+	} else if vlan.Attrs().Flags&net.FlagUp == 0 {
+		warnf("vlan %d on %q (%s) is down", conf.Vlan, conf.Master, vlan.Attrs().Name)
+	}
+	conf.Master = vlan.Attrs().Name
+	return nil
+}
+
+// createVlan creates the VLAN vlanID on top of master, holding the lock of
+// master so concurrent ADDs and other plugins do not create it twice.
+func createVlan(master netlink.Link, vlanID int) (netlink.Link, error) {
+	unlock, err := lockLink(master.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// another ADD may have created it while we waited for the lock
+	if vlan, err := findVlan(master, vlanID); err != nil || vlan != nil {
+		return vlan, err
+	}
+
+	name := vlanName(master.Attrs().Name, vlanID)
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: master.Attrs().Index,
+		},
+		VlanId: vlanID,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return nil, fmt.Errorf("failed to create vlan %d on %q as %q: %v", vlanID, master.Attrs().Name, name, err)
+	}
+	if err := netlink.LinkSetUp(vlan); err != nil {
+		_ = netlink.LinkDel(vlan)
+		return nil, fmt.Errorf("failed to set vlan %q up: %v", name, err)
+	}
+	return vlan, nil
+}
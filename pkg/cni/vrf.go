@@ -0,0 +1,127 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// freeVrfTable returns the lowest routing table id above the ones used by
+// the VRFs in links.
+func freeVrfTable(links []netlink.Link) uint32 {
+	table := uint32(1)
+	for _, link := range links {
+		if vrf, ok := link.(*netlink.Vrf); ok && vrf.Table >= table {
+			table = vrf.Table + 1
+		}
+	}
+	return table
+}
+
+// vrfAlias marks the VRFs the plugin created, and so may delete.
+const vrfAlias = aliasPrefix + " vrf"
+
+// ensureVrf returns the VRF called name in the current netns, creating it
+// (with the given routing table, or a free one when table is 0) if needed.
+func ensureVrf(name string, table uint32) (*netlink.Vrf, error) {
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		vrf, ok := link.(*netlink.Vrf)
+		if !ok {
+			return nil, fmt.Errorf("%q exists but is a %s device, not a vrf", name, link.Type())
+		}
+		if table != 0 && vrf.Table != table {
+			return nil, fmt.Errorf("vrf %q uses routing table %d, but table %d was requested", name, vrf.Table, table)
+		}
+		return vrf, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, fmt.Errorf("failed to lookup vrf %q: %v", name, err)
+	}
+
+	if table == 0 {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, err
+		}
+		table = freeVrfTable(links)
+	}
+	vrf := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: name}, Table: table}
+	if err := netlink.LinkAdd(vrf); err != nil {
+		return nil, fmt.Errorf("failed to create vrf %q: %v", name, err)
+	}
+	if err := netlink.LinkSetAlias(vrf, vrfAlias); err != nil {
+		netlink.LinkDel(vrf)
+		return nil, fmt.Errorf("failed to set the alias of vrf %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		netlink.LinkDel(vrf)
+		return nil, fmt.Errorf("failed to set vrf %q up: %v", name, err)
+	}
+	link, err = netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refetch vrf %q: %v", name, err)
+	}
+	return link.(*netlink.Vrf), nil
+}
+
+// addToVrf enslaves ifName to the VRF conf.Vrf inside netns.
+func addToVrf(conf *NetConf, ifName string, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		vrf, err := ensureVrf(conf.Vrf, conf.VrfTable)
+		if err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := netlink.LinkSetMasterByIndex(link, vrf.Index); err != nil {
+			return fmt.Errorf("failed to add %q to vrf %q: %v", ifName, conf.Vrf, err)
+		}
+		return nil
+	})
+}
+
+// removeVrfIfUnused deletes the VRF called name from the current netns once
+// no interface is enslaved to it anymore. VRFs the plugin did not create are
+// left alone.
+func removeVrfIfUnused(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if _, ok := link.(*netlink.Vrf); !ok || link.Attrs().Alias != vrfAlias {
+		return nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == link.Attrs().Index {
+			return nil
+		}
+	}
+	return netlink.LinkDel(link)
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// warnings collects the non-fatal issues hit by the current invocation. The
+// plugin handles a single command per process, so a package level list is
+// enough.
+var warnings []string
+
+// warnf records a non-fatal issue and logs it to stderr, which the runtime
+// captures, without failing the command.
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	warnings = append(warnings, msg)
+	fmt.Fprintf(os.Stderr, "macvtap-cni: warning: %s\n", msg)
+}
+
+// Warnings returns the non-fatal issues recorded so far.
+func Warnings() []string {
+	return warnings
+}
+
+func resetWarnings() {
+	warnings = nil
+}
+
+func warningsFilePath(dir, containerID, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+// writeWarnings stores the recorded warnings as a JSON list in dir, so
+// operators can inspect them without scraping the runtime logs.
+func writeWarnings(dir, containerID, ifName string) error {
+	if dir == "" || len(warnings) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create warnings dir %q: %v", dir, err)
+	}
+	data, err := json.Marshal(warnings)
+	if err != nil {
+		return err
+	}
+	path := warningsFilePath(dir, containerID, ifName)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write warnings file %q: %v", path, err)
+	}
+	return nil
+}
+
+func removeWarnings(dir, containerID, ifName string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.Remove(warningsFilePath(dir, containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}